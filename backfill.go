@@ -0,0 +1,154 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+// Return a New Instance of The Movie DB, sharing the same settings, for a
+// different Export Date
+func (tmdb *TheMovieDB) ForExportDate(date time.Time) *TheMovieDB {
+	day := newMovieDB(tmdb.APIKey, date)
+
+	day.APIURL = tmdb.APIURL
+	day.ExportsURL = tmdb.ExportsURL
+	day.RequestTimeout = tmdb.RequestTimeout
+	day.EntityTimeout = tmdb.EntityTimeout
+	day.Workers = tmdb.Workers
+	day.RateLimit = tmdb.RateLimit
+	day.Weights = tmdb.Weights
+	day.Filter = tmdb.Filter
+	day.Sample = tmdb.Sample
+	day.Shard = tmdb.Shard
+	day.PopularityOrder = tmdb.PopularityOrder
+
+	return day
+}
+
+// Return true if every Daily ID Export file is already present in the
+// export_date= partition under the output path
+func (tmdb *TheMovieDB) HasDailyExports(outputPath string) bool {
+	path := filepath.Join(outputPath, fmt.Sprintf("export_date=%s", tmdb.ExportDate.Format("2006-01-02")))
+
+	for _, dailyExport := range tmdb.DailyExports {
+		if _, err := os.Stat(filepath.Join(path, dailyExport.Name)); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+// Backfill the Daily ID Exports for every date in the range, inclusive, each
+// into its own export_date= partition.  Dates already present are skipped and
+// at most parallel dates are downloaded at once.  A failed date does not stop
+// the others, the failures are reported once the backfill is complete.
+func (tmdb *TheMovieDB) Backfill(ctx context.Context, outputPath string, from time.Time, to time.Time, parallel int) error {
+
+	if to.Before(from) {
+		return fmt.Errorf("invalid backfill range, %s is after %s", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	}
+
+	logger.Info().Msg("Initiating Backfill of Daily ID Exports")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	var skipped, completed int64
+	sem := make(chan struct{}, max(parallel, 1))
+
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		day := tmdb.ForExportDate(date)
+		if day.HasDailyExports(outputPath) {
+			logger.Debug().Str("export_date", date.Format("2006-01-02")).Msg("Daily Exports Present, Skipping")
+			skipped++
+			continue
+		}
+
+		// Stop starting new dates once a shutdown has been requested
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			logger.Info().Str("export_date", date.Format("2006-01-02")).Msg("Backfilling")
+
+			err := day.backfillDate(ctx, outputPath)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.Error().Err(err).Str("export_date", date.Format("2006-01-02")).Msg("Backfill Failed")
+				failed = append(failed, date.Format("2006-01-02"))
+				return
+			}
+			completed++
+		}()
+	}
+	wg.Wait()
+
+	logger.Info().Int64("backfilled", completed).Int64("skipped", skipped).Int("failed", len(failed)).Msg("Backfill Complete")
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("backfill interrupted: %w", err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("backfill failed for %d dates: %v", len(failed), failed)
+	}
+
+	return nil
+}
+
+// Download the Daily ID Exports of a single date, checking they have been
+// published before creating its partition.  A partition created for the date
+// is removed again on failure, so it is never mistaken for a completed day.
+func (tmdb *TheMovieDB) backfillDate(ctx context.Context, outputPath string) error {
+
+	if err := tmdb.checkDailyExports(ctx); err != nil {
+		return err
+	}
+
+	path := filepath.Join(outputPath, fmt.Sprintf("export_date=%s", tmdb.ExportDate.Format("2006-01-02")))
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+
+	err = tmdb.ValidateOutputPath(outputPath)
+	if err == nil {
+		err = tmdb.GetDailyExports(ctx)
+	}
+	if err != nil && created {
+		_ = os.RemoveAll(path)
+	}
+
+	return err
+}
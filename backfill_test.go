@@ -0,0 +1,101 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfill(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(2)
+	f.dates = map[string]bool{"04_28_2024": true, "04_29_2024": true, "04_30_2024": true, "05_01_2024": true}
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+	dir := t.TempDir()
+
+	// An existing partition is left untouched
+	existing := filepath.Join(dir, "export_date=2024-04-29")
+	if err := os.MkdirAll(existing, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, dailyExport := range tmdb.DailyExports {
+		if err := os.WriteFile(filepath.Join(existing, dailyExport.Name), []byte("existing\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if err := tmdb.Backfill(t.Context(), dir, from, to, 2); err != nil {
+		t.Fatalf("Backfill() error = %v", err)
+	}
+
+	for _, date := range []string{"2024-04-28", "2024-04-30", "2024-05-01"} {
+		lines := readLines(t, filepath.Join(dir, "export_date="+date, "movie_ids.json"))
+		if len(lines) != 2 {
+			t.Errorf("%s movie_ids.json has %d lines, want 2", date, len(lines))
+		}
+	}
+	if lines := readLines(t, filepath.Join(existing, "movie_ids.json")); len(lines) != 1 || lines[0] != "existing" {
+		t.Errorf("existing partition was overwritten: %v", lines)
+	}
+
+	// The original instance is unchanged
+	if got := tmdb.ExportDate.Format("2006-01-02"); got != testExportDate {
+		t.Errorf("ExportDate = %s, want %s", got, testExportDate)
+	}
+}
+
+func TestBackfillMissingDate(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.dates = map[string]bool{"04_29_2024": true, "05_01_2024": true}
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+	dir := t.TempDir()
+
+	from := time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	err := tmdb.Backfill(t.Context(), dir, from, to, 4)
+	if err == nil || !strings.Contains(err.Error(), "2024-04-30") {
+		t.Fatalf("Backfill() error = %v, want a failure for 2024-04-30", err)
+	}
+
+	// The other dates still complete
+	if !tmdb.ForExportDate(to).HasDailyExports(dir) || !tmdb.ForExportDate(from).HasDailyExports(dir) {
+		t.Error("expected the published dates to be backfilled")
+	}
+
+	// The missing date leaves no partition behind to be taken as complete
+	if _, err := os.Stat(filepath.Join(dir, "export_date=2024-04-30")); !os.IsNotExist(err) {
+		t.Error("export_date=2024-04-30 was created for a date that failed")
+	}
+}
+
+func TestBackfillInvalidRange(t *testing.T) {
+	tmdb := testMovieDB(t)
+
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if err := tmdb.Backfill(t.Context(), t.TempDir(), from, from.AddDate(0, 0, -1), 1); err == nil {
+		t.Error("Backfill() expected an error when from is after to")
+	}
+}
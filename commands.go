@@ -0,0 +1,716 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Commands which run in place of the crawl, named by the first argument
+var commands = map[string]func(args []string) error{
+	"popularity": popularityCommand,
+	"diff-ids":   diffIDsCommand,
+	"diff":       diffCommand,
+	"merge":      mergeCommand,
+	"fetch":      fetchCommand,
+	"shards":     shardsCommand,
+	"coordinate": coordinateCommand,
+	"work":       workCommand,
+	"daemon":     daemonCommand,
+	"prune":      pruneCommand,
+}
+
+//---------------------------------------------------------------------------------------
+
+// Run the named Command and Exit
+func runCommand(name string, args []string) {
+	if err := commands[name](args); err != nil {
+		logger.Error().Err(err).Msgf("Command %s Failed", name)
+		os.Exit(1)
+	}
+
+	logger.Info().Msg("Done!")
+	os.Exit(0)
+}
+
+// Return a New Flag Set for the named Command with matching usage text
+func newFlagSet(name string, usage string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, applicationText, filepath.Base(os.Args[0]), "\n")
+		fmt.Fprint(os.Stderr, copyrightText)
+		fmt.Fprintf(os.Stderr, "\n%s\n\n\nUSAGE:\n    get-tmdb %s\n\nARGS:\n", description, usage)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// Parse an optional date flag, an empty date is returned as the zero time
+func parseDateFlag(name string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s date %q, expected YYYY-MM-DD: %w", name, value, err)
+	}
+
+	return date, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+// Build a Popularity History from the Daily Export IDs in every partition
+func popularityCommand(args []string) error {
+	fs := newFlagSet("popularity", "popularity -o OUTPUT_PATH",
+		"Ingest the Daily Export IDs across the export_date= partitions and\n"+
+			"write a long-format popularity history as JSONL.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var historyFile = fs.String("f", "", "Popularity History File, Defaults to OUTPUT_PATH/popularity_history.json")
+	var from = fs.String("from", "", "Only Include Export Dates From this Date")
+	var to = fs.String("to", "", "Only Include Export Dates To this Date")
+	var entities = fs.String("entities", strings.Join(PopularityEntities, ","), "Entities to Include")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *historyFile == "" {
+		*historyFile = filepath.Join(*outputPath, "popularity_history.json")
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("Popularity History File", *historyFile).Msg(indent)
+	logger.Info().Str("From", *from).Msg(indent)
+	logger.Info().Str("To", *to).Msg(indent)
+	logger.Info().Str("Entities", *entities).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	fromDate, err := parseDateFlag("from", *from)
+	if err != nil {
+		return err
+	}
+	toDate, err := parseDateFlag("to", *to)
+	if err != nil {
+		return err
+	}
+	selected, err := ParseEntities(*entities, PopularityEntities)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := ListPartitions(*outputPath)
+	if err != nil {
+		return err
+	}
+	partitions = FilterPartitions(partitions, fromDate, toDate)
+
+	wf, err := os.Create(*historyFile)
+	if err != nil {
+		return fmt.Errorf("failed to open the popularity history file: %w", err)
+	}
+	defer func() { _ = wf.Close() }()
+
+	if _, err := WritePopularityHistory(wf, partitions, selected); err != nil {
+		return err
+	}
+
+	return wf.Close()
+}
+
+//---------------------------------------------------------------------------------------
+
+// Diff the Daily Export IDs of two partitions
+func diffIDsCommand(args []string) error {
+	fs := newFlagSet("diff-ids", "diff-ids -o OUTPUT_PATH -from DATE -to DATE",
+		"Compare the Daily Export IDs of two export_date= partitions and write\n"+
+			"the added and removed ID records for each entity.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var from = fs.String("from", "", "Older Export Date  (Required)")
+	var to = fs.String("to", "", "Newer Export Date  (Required)")
+	var diffPath = fs.String("d", "", "Diff Path, Defaults to OUTPUT_PATH/diff_ids/from=FROM_to=TO")
+	var entities = fs.String("entities", strings.Join(Entities, ","), "Entities to Include")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *from == "" || *to == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *diffPath == "" {
+		*diffPath = filepath.Join(*outputPath, "diff_ids", fmt.Sprintf("from=%s_to=%s", *from, *to))
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("From", *from).Msg(indent)
+	logger.Info().Str("To", *to).Msg(indent)
+	logger.Info().Str("Diff Path", *diffPath).Msg(indent)
+	logger.Info().Str("Entities", *entities).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	fromPartition, toPartition, err := findPartitions(*outputPath, *from, *to)
+	if err != nil {
+		return err
+	}
+	selected, err := ParseEntities(*entities, Entities)
+	if err != nil {
+		return err
+	}
+
+	_, err = DiffIDs(fromPartition, toPartition, *diffPath, selected)
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+// Diff the Entity Data of two partitions
+func diffCommand(args []string) error {
+	fs := newFlagSet("diff", "diff -o OUTPUT_PATH -from DATE -to DATE",
+		"Compare the entity data files of two export_date= partitions by ID and\n"+
+			"write the inserted, updated and deleted records as change events.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var from = fs.String("from", "", "Older Export Date  (Required)")
+	var to = fs.String("to", "", "Newer Export Date  (Required)")
+	var diffPath = fs.String("d", "", "Diff Path, Defaults to OUTPUT_PATH/diff/from=FROM_to=TO")
+	var entities = fs.String("entities", strings.Join(Entities, ","), "Entities to Include")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *from == "" || *to == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *diffPath == "" {
+		*diffPath = filepath.Join(*outputPath, "diff", fmt.Sprintf("from=%s_to=%s", *from, *to))
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("From", *from).Msg(indent)
+	logger.Info().Str("To", *to).Msg(indent)
+	logger.Info().Str("Diff Path", *diffPath).Msg(indent)
+	logger.Info().Str("Entities", *entities).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	fromPartition, toPartition, err := findPartitions(*outputPath, *from, *to)
+	if err != nil {
+		return err
+	}
+	selected, err := ParseEntities(*entities, Entities)
+	if err != nil {
+		return err
+	}
+
+	_, err = DiffData(fromPartition, toPartition, *diffPath, selected)
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+// Merge the Entity Data of a partition into the Snapshot Store
+func mergeCommand(args []string) error {
+	fs := newFlagSet("merge", "merge -o OUTPUT_PATH -exportDate DATE",
+		"Fold the entity data files of an export_date= partition into the\n"+
+			"cumulative snapshot store, keeping a valid_from / valid_to history\n"+
+			"of every version of every record.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var exportDate = fs.String("exportDate", "", "Export Date to Merge  (Required)")
+	var storePath = fs.String("s", "", "Snapshot Store Path, Defaults to OUTPUT_PATH/store")
+	var entities = fs.String("entities", strings.Join(Entities, ","), "Entities to Include")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *exportDate == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *storePath == "" {
+		*storePath = filepath.Join(*outputPath, "store")
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("Export Date", *exportDate).Msg(indent)
+	logger.Info().Str("Snapshot Store Path", *storePath).Msg(indent)
+	logger.Info().Str("Entities", *entities).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	date, err := parseDateFlag("exportDate", *exportDate)
+	if err != nil {
+		return err
+	}
+	partition, err := FindPartition(*outputPath, date)
+	if err != nil {
+		return err
+	}
+	selected, err := ParseEntities(*entities, Entities)
+	if err != nil {
+		return err
+	}
+
+	store, err := OpenSnapshotStore(*storePath)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Merge(partition, selected)
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+// Fetch the Data for an explicit list of IDs
+func fetchCommand(args []string) error {
+	fs := newFlagSet("fetch", "fetch -a API_KEY -o OUTPUT_PATH -entity ENTITY -ids FILE",
+		"Fetch the data for an explicit list of IDs of a single entity, read from\n"+
+			"a file, stdin or the command line, in place of the Daily ID Export.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var tmdbAPIKey = fs.String("a", "", "The Movie DB API Key  (Required)")
+	var entity = fs.String("entity", "", "Entity of the IDs, e.g. movie or tv_series  (Required)")
+	var idFile = fs.String("ids", "", "File of IDs to Fetch, or - to Read from Stdin")
+	var idList = fs.String("idList", "", "Comma Separated IDs to Fetch")
+	var requestTimeout = fs.Duration("requestTimeout", defaultRequestTimeout, "Timeout for a Single API Request, Including Retries, Must be Positive")
+	var workers = fs.Int64("workers", numWorkers, "Number of Workers")
+	var rateLimit = fs.Float64("rateLimit", 0, "Maximum API Requests per Second")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *tmdbAPIKey == "" || *entity == "" || (*idFile == "" && *idList == "") || *requestTimeout <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("The Movie DB API Key", *tmdbAPIKey).Msg(indent)
+	logger.Info().Str("Entity", *entity).Msg(indent)
+	logger.Info().Str("ID File", *idFile).Msg(indent)
+	logger.Info().Str("ID List", *idList).Msg(indent)
+	logger.Info().Dur("Request Timeout", *requestTimeout).Msg(indent)
+	logger.Info().Int64("Workers", *workers).Msg(indent)
+	logger.Info().Float64("Rate Limit", *rateLimit).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	key, err := FindEntity(*entity)
+	if err != nil {
+		return err
+	}
+	ids, err := readIDList(*idFile, *idList)
+	if err != nil {
+		return err
+	}
+	logger.Info().Int("ids", len(ids)).Msg("IDs Read")
+
+	tmdb, err := NewMovieDB(*tmdbAPIKey, "")
+	if err != nil {
+		return err
+	}
+	tmdb.RequestTimeout = *requestTimeout
+	tmdb.Workers = max(*workers, 1)
+	tmdb.RateLimit = *rateLimit
+
+	if tmdb.OutputPath, err = filepath.Abs(*outputPath); err != nil {
+		return fmt.Errorf("failed to get absolute output path: %w", err)
+	}
+	if err := os.MkdirAll(tmdb.OutputPath, 0700); err != nil {
+		return fmt.Errorf("failed to create the output file path: %w", err)
+	}
+	if err := tmdb.SetIDList(key, ids); err != nil {
+		return err
+	}
+
+	err = tmdb.ExportEntityData(ctx, key)
+	tmdb.Close()
+	writeProgress(tmdb)
+
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+// Check the Shards of a partition cover its Daily Export IDs
+func shardsCommand(args []string) error {
+	fs := newFlagSet("shards", "shards -o OUTPUT_PATH -exportDate DATE -n COUNT",
+		"Check the shard data files of an export_date= partition together cover\n"+
+			"its Daily Export IDs, writing any missing IDs so they can be fetched.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var exportDate = fs.String("exportDate", "", "Export Date to Check  (Required)")
+	var count = fs.Int64("n", 0, "Number of Shards  (Required)")
+	var combine = fs.Bool("combine", false, "Combine the Shard Data Files into the Unsharded Data Files")
+	var entities = fs.String("entities", strings.Join(Entities, ","), "Entities to Include")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *exportDate == "" || *count < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("Export Date", *exportDate).Msg(indent)
+	logger.Info().Int64("Number of Shards", *count).Msg(indent)
+	logger.Info().Bool("Combine", *combine).Msg(indent)
+	logger.Info().Str("Entities", *entities).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	date, err := parseDateFlag("exportDate", *exportDate)
+	if err != nil {
+		return err
+	}
+	partition, err := FindPartition(*outputPath, date)
+	if err != nil {
+		return err
+	}
+	selected, err := ParseEntities(*entities, Entities)
+	if err != nil {
+		return err
+	}
+
+	_, err = CheckShards(partition, *count, selected, *combine)
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+// Coordinate a Distributed Crawl by remote workers
+func coordinateCommand(args []string) error {
+	fs := newFlagSet("coordinate", "coordinate -a API_KEY -o OUTPUT_PATH",
+		"Download the Daily ID Exports and lease chunks of IDs to remote workers\n"+
+			"over HTTP, assembling their results into the entity data files.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var tmdbAPIKey = fs.String("a", "", "The Movie DB API Key  (Required)")
+	var exportDate = fs.String("exportDate", "", "Export Date Override")
+	var listen = fs.String("listen", "localhost:8080", "Address the Coordinator Listens On, e.g. :8080 for Every Interface")
+	var token = fs.String("token", "", "Shared Token Workers Must Send, Recommended When Listening Beyond localhost")
+	var leaseSize = fs.Int("leaseSize", 500, "Number of IDs in Each Lease")
+	var leaseTimeout = fs.Duration("leaseTimeout", 5*time.Minute, "Time a Worker has to Complete a Lease Before it is Reassigned")
+	var linger = fs.Duration("linger", 30*time.Second, "Time to Keep Serving Once Complete, so Polling Workers Exit")
+	var entities = fs.String("entities", strings.Join(Entities, ","), "Entities to Include")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *tmdbAPIKey == "" || *leaseSize < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("The Movie DB API Key", *tmdbAPIKey).Msg(indent)
+	logger.Info().Str("Export Date Override", *exportDate).Msg(indent)
+	logger.Info().Str("Listen", *listen).Msg(indent)
+	logger.Info().Bool("Token Required", *token != "").Msg(indent)
+	logger.Info().Int("Lease Size", *leaseSize).Msg(indent)
+	logger.Info().Dur("Lease Timeout", *leaseTimeout).Msg(indent)
+	logger.Info().Dur("Linger", *linger).Msg(indent)
+	logger.Info().Str("Entities", *entities).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	selected, err := ParseEntities(*entities, Entities)
+	if err != nil {
+		return err
+	}
+	tmdb, err := NewMovieDB(*tmdbAPIKey, *exportDate)
+	if err != nil {
+		return err
+	}
+	if err := tmdb.CheckDailyExports(ctx, false); err != nil {
+		return err
+	}
+	if err := tmdb.ValidateOutputPath(*outputPath); err != nil {
+		return err
+	}
+	if err := tmdb.GetDailyExports(ctx); err != nil {
+		return err
+	}
+
+	coordinator, err := NewCoordinator(tmdb, selected, *leaseSize, *leaseTimeout)
+	if err != nil {
+		return err
+	}
+	coordinator.Token = *token
+	err = coordinator.Serve(ctx, *listen, *linger)
+	writeProgress(tmdb)
+
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+// Work for a Coordinator of a Distributed Crawl
+func workCommand(args []string) error {
+	fs := newFlagSet("work", "work -a API_KEY -coordinator URL",
+		"Lease chunks of IDs from a coordinator, fetch their data and send the\n"+
+			"records back, until the crawl is complete.")
+
+	var tmdbAPIKey = fs.String("a", "", "The Movie DB API Key  (Required)")
+	var coordinatorURL = fs.String("coordinator", "", "URL of the Coordinator, e.g. http://host:8080  (Required)")
+	var token = fs.String("token", "", "Shared Token of the Coordinator, if any")
+	var name = fs.String("name", "", "Worker Name, Defaults to the Host Name")
+	var pollInterval = fs.Duration("pollInterval", 5*time.Second, "Time to Wait When No Lease is Free")
+	var requestTimeout = fs.Duration("requestTimeout", defaultRequestTimeout, "Timeout for a Single API Request, Including Retries, Must be Positive")
+	var workers = fs.Int64("workers", numWorkers, "Number of Workers")
+	var rateLimit = fs.Float64("rateLimit", 0, "Maximum API Requests per Second")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *tmdbAPIKey == "" || *coordinatorURL == "" || *requestTimeout <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *name == "" {
+		*name, _ = os.Hostname()
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("The Movie DB API Key", *tmdbAPIKey).Msg(indent)
+	logger.Info().Str("Coordinator", *coordinatorURL).Msg(indent)
+	logger.Info().Bool("Token Given", *token != "").Msg(indent)
+	logger.Info().Str("Worker Name", *name).Msg(indent)
+	logger.Info().Dur("Poll Interval", *pollInterval).Msg(indent)
+	logger.Info().Dur("Request Timeout", *requestTimeout).Msg(indent)
+	logger.Info().Int64("Workers", *workers).Msg(indent)
+	logger.Info().Float64("Rate Limit", *rateLimit).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tmdb, err := NewMovieDB(*tmdbAPIKey, "")
+	if err != nil {
+		return err
+	}
+	pool := NewWorkerPool(max(*workers, 1), *rateLimit, nil, tmdb.APIURL, tmdb.APIKey, *requestTimeout)
+	defer pool.Close()
+
+	return RunWorker(ctx, *coordinatorURL, *token, *name, pool, *pollInterval)
+}
+
+//---------------------------------------------------------------------------------------
+
+// Run the Export Every Day Once the Daily ID Exports are Published
+func daemonCommand(args []string) error {
+	fs := newFlagSet("daemon", "daemon -a API_KEY -o OUTPUT_PATH [CRAWL_ARGS]",
+		"Run the crawl every day once the Daily ID Exports have been published,\n"+
+			"passing any arguments after the flags through to each crawl.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var tmdbAPIKey = fs.String("a", "", "The Movie DB API Key  (Required)")
+	var at = fs.String("at", "08:15", "Time of Day the Crawl Runs, HH:MM in UTC")
+	var retryInterval = fs.Duration("retryInterval", 15*time.Minute, "Time to Wait Before Checking Again for the Daily ID Exports")
+	var retryFor = fs.Duration("retryFor", 12*time.Hour, "Time to Keep Checking for the Daily ID Exports Each Day")
+	var statusListen = fs.String("statusListen", "", "Address to Serve the Daemon Status On, e.g. :8081")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *tmdbAPIKey == "" || *retryInterval <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Str("The Movie DB API Key", *tmdbAPIKey).Msg(indent)
+	logger.Info().Str("Run At", *at).Msg(indent)
+	logger.Info().Dur("Retry Interval", *retryInterval).Msg(indent)
+	logger.Info().Dur("Retry For", *retryFor).Msg(indent)
+	logger.Info().Str("Status Listen", *statusListen).Msg(indent)
+	logger.Info().Strs("Crawl Arguments", fs.Args()).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	runAt, err := time.Parse("15:04", *at)
+	if err != nil {
+		return fmt.Errorf("invalid -at time %q, expected HH:MM: %w", *at, err)
+	}
+	for _, arg := range fs.Args() {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name == "a" || name == "o" || name == "exportDate" {
+			return fmt.Errorf("the crawl argument -%s is set by the daemon", name)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tmdb, err := NewMovieDB(*tmdbAPIKey, "")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outputPath, 0700); err != nil {
+		return fmt.Errorf("failed to create the output path: %w", err)
+	}
+
+	daemon := &Daemon{
+		TMDB:          tmdb,
+		OutputPath:    *outputPath,
+		At:            time.Duration(runAt.Hour())*time.Hour + time.Duration(runAt.Minute())*time.Minute,
+		RetryInterval: *retryInterval,
+		RetryFor:      *retryFor,
+		Run:           execExport(append([]string{"-a", *tmdbAPIKey, "-o", *outputPath}, fs.Args()...)),
+	}
+
+	if *statusListen != "" {
+		server, err := daemon.Serve(*statusListen)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = server.Close() }()
+	}
+
+	return daemon.Loop(ctx)
+}
+
+//---------------------------------------------------------------------------------------
+
+// Prune the Partitions Outside the Retention Policy
+func pruneCommand(args []string) error {
+	fs := newFlagSet("prune", "prune -o OUTPUT_PATH -keep N",
+		"Remove the export_date= partitions outside the retention policy, keeping\n"+
+			"the latest N and optionally the first partition of each month.")
+
+	var outputPath = fs.String("o", "", "Output Path  (Required)")
+	var keep = fs.Int("keep", 0, "Number of the Latest Partitions Kept  (Required)")
+	var keepMonthly = fs.Bool("keepMonthly", false, "Also Keep the First Partition of Each Month")
+	var dryRun = fs.Bool("dryRun", false, "List the Partitions that would be Pruned Without Removing Them")
+	var logOptions = logFlags(fs)
+	var verbose = fs.Bool("v", false, "Output Verbose Detail")
+	_ = fs.Parse(args)
+
+	// Validate the Required Flags
+	if *outputPath == "" || *keep < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	setupLogger(*verbose, logOptions)
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Output Path", *outputPath).Msg(indent)
+	logger.Info().Int("Keep Partitions", *keep).Msg(indent)
+	logger.Info().Bool("Keep Monthly Partitions", *keepMonthly).Msg(indent)
+	logger.Info().Bool("Dry Run", *dryRun).Msg(indent)
+	logger.Info().Msg("Begin")
+
+	_, err := PrunePartitions(*outputPath, RetentionPolicy{*keep, *keepMonthly}, *dryRun, "")
+
+	return err
+}
+
+// Find the pair of Partitions to compare
+func findPartitions(outputPath string, from string, to string) (Partition, Partition, error) {
+	fromDate, err := parseDateFlag("from", from)
+	if err != nil {
+		return Partition{}, Partition{}, err
+	}
+	toDate, err := parseDateFlag("to", to)
+	if err != nil {
+		return Partition{}, Partition{}, err
+	}
+
+	fromPartition, err := FindPartition(outputPath, fromDate)
+	if err != nil {
+		return Partition{}, Partition{}, err
+	}
+	toPartition, err := FindPartition(outputPath, toDate)
+	if err != nil {
+		return Partition{}, Partition{}, err
+	}
+
+	return fromPartition, toPartition, nil
+}
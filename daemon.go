@@ -0,0 +1,270 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Daemon running the export once a day, after the Daily ID Exports have been
+// published.  Each day it waits until the run time, checks the Daily ID
+// Exports are available, retrying until they are, and then runs the export.
+type Daemon struct {
+	TMDB          *TheMovieDB
+	OutputPath    string
+	At            time.Duration
+	RetryInterval time.Duration
+	RetryFor      time.Duration
+	Run           func(ctx context.Context, date time.Time) error
+
+	mu     sync.Mutex
+	status DaemonStatus
+}
+
+type DaemonStatus struct {
+	State   string     `json:"state"`
+	NextRun time.Time  `json:"next_run,omitzero"`
+	LastRun *DaemonRun `json:"last_run,omitempty"`
+}
+
+type DaemonRun struct {
+	ExportDate string    `json:"export_date"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished,omitzero"`
+	Checks     int       `json:"checks"`
+	Attempts   int       `json:"attempts"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+}
+
+//---------------------------------------------------------------------------------------
+
+// Run the Export every day until the context is done
+func (d *Daemon) Loop(ctx context.Context) error {
+	first := true
+	for {
+		now := time.Now().UTC()
+		next := d.nextRun(now, first)
+		first = false
+
+		d.setState("waiting", next)
+		logger.Info().Time("Next Run", next).Msg(indent)
+		sleepContext(ctx, next.Sub(now))
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		d.RunDay(ctx, next.Truncate(24*time.Hour))
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// Return the time of the next run, today's run time if it is still to come.
+// On the first run, if today's run time has passed and today's partition does
+// not exist, it runs straight away.
+func (d *Daemon) nextRun(now time.Time, first bool) time.Time {
+	today := now.Truncate(24 * time.Hour)
+	at := today.Add(d.At)
+
+	switch {
+	case now.Before(at):
+		return at
+	case first && !d.completedDay(today):
+		return now
+	default:
+		return at.AddDate(0, 0, 1)
+	}
+}
+
+// Return true if the partition of the date holds a completed crawl, its
+// progress.json recording every entity as complete.  A partition left by a
+// failed or interrupted crawl is run again.
+func (d *Daemon) completedDay(date time.Time) bool {
+	partition, err := FindPartition(d.OutputPath, date)
+	if err != nil {
+		return false
+	}
+	progress, err := readProgress(partition)
+	if err != nil || len(progress) == 0 {
+		return false
+	}
+	for _, p := range progress {
+		if !p.complete() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Serve the Daemon Status on the address, failing if it cannot be bound
+func (d *Daemon) Serve(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the daemon status on %s: %w", addr, err)
+	}
+
+	server := &http.Server{Addr: addr, Handler: d}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("Daemon Status Server Failed")
+		}
+	}()
+	logger.Info().Str("Daemon Status Listening On", ln.Addr().String()).Msg(indent)
+
+	return server, nil
+}
+
+// Run the Export for the date once the Daily ID Exports are available.  The
+// availability is checked every retry interval, and an export which finds
+// them unavailable is retried, until the retry period is over.
+func (d *Daemon) RunDay(ctx context.Context, date time.Time) *DaemonRun {
+	run := &DaemonRun{ExportDate: date.Format("2006-01-02"), Started: time.Now().UTC()}
+	deadline := run.Started.Add(d.RetryFor)
+	logger.Info().Str("export_date", run.ExportDate).Msg("Daemon Run Starting")
+
+	for {
+		d.updateRun("checking", run)
+		err := d.TMDB.ForExportDate(date).CheckDailyExports(ctx, false)
+		run.Checks++
+
+		if err == nil {
+			d.updateRun("running", run)
+			run.Attempts++
+			err = d.Run(ctx, date)
+			run.ExitCode = exitCode(err)
+			if run.ExitCode != exitNotAvailable {
+				run.Error = errorString(err)
+				break
+			}
+		}
+
+		if ctx.Err() != nil || !time.Now().Add(d.RetryInterval).Before(deadline) {
+			run.Error = fmt.Sprintf("daily ID exports not available: %v", err)
+			break
+		}
+		logger.Warn().Err(err).Int64("retry_in_ms", d.RetryInterval.Milliseconds()).Msg("Daily ID Exports Not Available")
+		sleepContext(ctx, d.RetryInterval)
+	}
+
+	run.Finished = time.Now().UTC()
+	d.updateRun("finished", run)
+	if run.Error != "" {
+		logger.Error().Str("export_date", run.ExportDate).Int("exit_code", run.ExitCode).Str("error", run.Error).Msg("Daemon Run Failed")
+	} else {
+		logger.Info().Str("export_date", run.ExportDate).Msg("Daemon Run Completed")
+	}
+
+	d.writeStatus()
+
+	return run
+}
+
+// Return the exit code of the export, zero on success and one for an error
+// other than an exit status
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		return 1
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+//---------------------------------------------------------------------------------------
+
+func (d *Daemon) setState(state string, next time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.State = state
+	d.status.NextRun = next
+}
+
+func (d *Daemon) updateRun(state string, run *DaemonRun) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.State = state
+	d.status.NextRun = time.Time{}
+	r := *run
+	d.status.LastRun = &r
+}
+
+// Return a copy of the Daemon Status
+func (d *Daemon) Status() DaemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// Serve the Daemon Status as JSON
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, d.Status())
+}
+
+// Write the Daemon Status to daemon_status.json under the output path
+func (d *Daemon) writeStatus() {
+	data, err := json.MarshalIndent(d.Status(), "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(d.OutputPath, "daemon_status.json"), data, 0600)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Write Daemon Status Failed")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+// Return a Run function executing this binary with the arguments and the
+// export date.  Cancelling the context interrupts the export so it can drain
+// its in-flight requests and record its progress.
+func execExport(args []string) func(ctx context.Context, date time.Time) error {
+	return func(ctx context.Context, date time.Time) error {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find the executable: %w", err)
+		}
+
+		cmd := exec.CommandContext(ctx, exe, append(slices.Clone(args), "-exportDate", date.Format("2006-01-02"))...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+		cmd.WaitDelay = 5 * time.Minute
+
+		return cmd.Run()
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDaemonNextRun(t *testing.T) {
+	dir := t.TempDir()
+	d := &Daemon{OutputPath: dir, At: 8*time.Hour + 15*time.Minute}
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := day.Add(d.At)
+	late := day.Add(10 * time.Hour)
+
+	if got := d.nextRun(day.Add(time.Hour), true); !got.Equal(at) {
+		t.Errorf("nextRun(before) = %v, want %v", got, at)
+	}
+	if got := d.nextRun(late, false); !got.Equal(at.AddDate(0, 0, 1)) {
+		t.Errorf("nextRun(after) = %v, want tomorrow", got)
+	}
+
+	// Starting late runs straight away unless today's crawl completed
+	if got := d.nextRun(late, true); !got.Equal(late) {
+		t.Errorf("nextRun(first, late) = %v, want %v", got, late)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "export_date=2024-05-01"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.nextRun(late, true); !got.Equal(late) {
+		t.Errorf("nextRun(first, empty partition) = %v, want %v", got, late)
+	}
+	writePartition(t, dir, "2024-05-01", map[string]string{"progress.json": `{"Movie":{"interrupted":true}}`})
+	if got := d.nextRun(late, true); !got.Equal(late) {
+		t.Errorf("nextRun(first, interrupted) = %v, want %v", got, late)
+	}
+	writePartition(t, dir, "2024-05-01", map[string]string{"progress.json": `{"Movie":{"records_exported":1}}`})
+	if got := d.nextRun(late, true); !got.Equal(at.AddDate(0, 0, 1)) {
+		t.Errorf("nextRun(first, done) = %v, want tomorrow", got)
+	}
+}
+
+func TestDaemonRunDay(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.mu.Lock()
+	f.dates = map[string]bool{}
+	f.mu.Unlock()
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+
+	var runs []string
+	d := &Daemon{
+		TMDB:          tmdb,
+		OutputPath:    t.TempDir(),
+		RetryInterval: 5 * time.Millisecond,
+		RetryFor:      5 * time.Second,
+		Run: func(ctx context.Context, date time.Time) error {
+			runs = append(runs, date.Format("2006-01-02"))
+			return nil
+		},
+	}
+
+	// The Daily ID Exports are published after the first check
+	time.AfterFunc(20*time.Millisecond, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.dates["05_01_2024"] = true
+	})
+
+	run := d.RunDay(t.Context(), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	if run.Error != "" || run.ExitCode != 0 || run.Attempts != 1 || run.Checks < 2 {
+		t.Errorf("run = %+v", *run)
+	}
+	if len(runs) != 1 || runs[0] != "2024-05-01" {
+		t.Errorf("runs = %v", runs)
+	}
+
+	// The status is written to the output path and served over HTTP
+	data, err := os.ReadFile(filepath.Join(d.OutputPath, "daemon_status.json"))
+	if err != nil {
+		t.Fatalf("failed to read the daemon status: %v", err)
+	}
+	var status DaemonStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("failed to unmarshal the daemon status: %v", err)
+	}
+	if status.State != "finished" || status.LastRun == nil || status.LastRun.ExportDate != "2024-05-01" {
+		t.Errorf("status = %+v", status)
+	}
+
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || status.State != "finished" {
+		t.Errorf("served status = %s, %v", rec.Body.String(), err)
+	}
+}
+
+func TestDaemonRunDayGivesUp(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.mu.Lock()
+	f.dates = map[string]bool{}
+	f.mu.Unlock()
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+
+	d := &Daemon{
+		TMDB:          tmdb,
+		OutputPath:    t.TempDir(),
+		RetryInterval: 10 * time.Millisecond,
+		RetryFor:      50 * time.Millisecond,
+		Run: func(ctx context.Context, date time.Time) error {
+			return errors.New("should not run")
+		},
+	}
+
+	run := d.RunDay(t.Context(), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	if run.Attempts != 0 || run.Checks < 2 || run.Error == "" {
+		t.Errorf("run = %+v", *run)
+	}
+}
+
+func TestDaemonServe(t *testing.T) {
+	d := &Daemon{OutputPath: t.TempDir()}
+	server, err := d.Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	// An address already in use is an error rather than a daemon without status
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	if _, err := d.Serve(ln.Addr().String()); err == nil {
+		t.Error("expected an error for an address already in use")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Maximum size of a single record in an entity data file
+const maxRecordSize = 16 * 1024 * 1024
+
+// A single change to a record between two entity data files
+type ChangeEvent struct {
+	Entity  string          `json:"entity"`
+	Id      int64           `json:"id"`
+	Op      string          `json:"op"`
+	Changes []FieldChange   `json:"changes,omitempty"`
+	Record  json.RawMessage `json:"record,omitempty"`
+}
+
+// A top-level field whose value changed, a missing field has a null value
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
+
+// Counts of the changes between two entity data files
+type DiffSummary struct {
+	Inserted  int64 `json:"inserted"`
+	Updated   int64 `json:"updated"`
+	Deleted   int64 `json:"deleted"`
+	Unchanged int64 `json:"unchanged"`
+}
+
+// Location and hash of a record in the older entity data file
+type recordIndex struct {
+	offset int64
+	length int
+	hash   uint64
+	seen   bool
+}
+
+//---------------------------------------------------------------------------------------
+
+// Compare the entity data files of two partitions by ID and write, for each
+// entity, a JSONL file of insert, update and delete change events along with
+// a summary.json of the counts.  A record is only deleted when its ID is no
+// longer in the newer partition's Daily Export IDs, so a record missing
+// because its request failed is not, and an entity whose export in either
+// partition was incomplete is skipped.
+func DiffData(from Partition, to Partition, diffPath string, entities []string) (map[string]*DiffSummary, error) {
+
+	logger.Info().Msg("Initiating Diff of Entity Data")
+
+	if err := os.MkdirAll(diffPath, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the diff path: %w", err)
+	}
+
+	fromProgress, err := readProgress(from)
+	if err != nil {
+		return nil, err
+	}
+	toProgress, err := readProgress(to)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := map[string]*DiffSummary{}
+	for _, entity := range entities {
+		name := fmt.Sprintf("%s.json", entityFileName(entity))
+		fromFile := filepath.Join(from.Path, name)
+		toFile := filepath.Join(to.Path, name)
+
+		if !fileExists(fromFile) || !fileExists(toFile) {
+			logger.Warn().Str("entity", entity).Msg("Entity Data Missing, Skipping")
+			continue
+		}
+		idsFile := filepath.Join(to.Path, NewDailyExports()[entity].Name)
+		if !fileExists(idsFile) {
+			logger.Warn().Str("entity", entity).Msg("Daily Export IDs Missing, Skipping")
+			continue
+		}
+		if p, q := fromProgress[entity], toProgress[entity]; (p != nil && !p.complete()) || (q != nil && !q.complete()) {
+			logger.Warn().Str("entity", entity).Msg("Entity Export Incomplete, Skipping")
+			continue
+		}
+
+		s, err := diffDataFiles(entity, fromFile, toFile, idsFile, filepath.Join(diffPath, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s diff failed: %w", entity, err)
+		}
+		summary[entity] = s
+
+		logger.Info().Str("entity", entity).
+			Int64("inserted", s.Inserted).Int64("updated", s.Updated).Int64("deleted", s.Deleted).Msg(indent)
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the diff summary: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(diffPath, "summary.json"), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write the diff summary: %w", err)
+	}
+
+	return summary, nil
+}
+
+// Diff a pair of entity data files.  The older file is indexed by ID with the
+// offset and hash of each record so only changed records are read back.  The
+// IDs listed in the newer Daily Export are never deleted.
+func diffDataFiles(entity string, fromFile string, toFile string, idsFile string, changesFile string) (*DiffSummary, error) {
+	summary := new(DiffSummary)
+
+	listed := map[int64]bool{}
+	if err := scanIDFile(idsFile, func(id int64, line []byte) error {
+		listed[id] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	index := map[int64]*recordIndex{}
+	if err := scanDataFile(fromFile, func(id int64, offset int64, line []byte) error {
+		index[id] = &recordIndex{offset: offset, length: len(line), hash: hashRecord(line)}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	rf, err := os.Open(fromFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the entity data file: %w", err)
+	}
+	defer func() { _ = rf.Close() }()
+
+	err = writeLines(changesFile, func(w *bufio.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+
+		// Every record in the newer file is either inserted, updated or unchanged
+		err := scanDataFile(toFile, func(id int64, offset int64, line []byte) error {
+			old, ok := index[id]
+			if !ok {
+				summary.Inserted++
+				return enc.Encode(ChangeEvent{Entity: entity, Id: id, Op: "insert", Record: slices.Clone(line)})
+			}
+			old.seen = true
+			if old.hash == hashRecord(line) {
+				summary.Unchanged++
+				return nil
+			}
+
+			record := make([]byte, old.length)
+			if _, err := rf.ReadAt(record, old.offset); err != nil {
+				return fmt.Errorf("failed reading the entity data file: %w", err)
+			}
+			changes, err := diffFields(record, line)
+			if err != nil {
+				return fmt.Errorf("failed to compare record %d: %w", id, err)
+			}
+			if len(changes) == 0 {
+				summary.Unchanged++
+				return nil
+			}
+			summary.Updated++
+			return enc.Encode(ChangeEvent{Entity: entity, Id: id, Op: "update", Changes: changes})
+		})
+		if err != nil {
+			return err
+		}
+
+		// Anything in the older file not seen in the newer file, and no longer
+		// listed in its Daily Export IDs, was deleted
+		return scanDataFile(fromFile, func(id int64, offset int64, line []byte) error {
+			if index[id].seen || listed[id] {
+				return nil
+			}
+			summary.Deleted++
+			return enc.Encode(ChangeEvent{Entity: entity, Id: id, Op: "delete", Record: slices.Clone(line)})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// Return the top-level fields whose values differ between the two records,
+// in field name order
+func diffFields(oldRecord []byte, newRecord []byte) ([]FieldChange, error) {
+	var oldFields, newFields map[string]json.RawMessage
+	if err := json.Unmarshal(oldRecord, &oldFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(newRecord, &newFields); err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	for field := range oldFields {
+		fields = append(fields, field)
+	}
+	for field := range newFields {
+		if _, ok := oldFields[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	slices.Sort(fields)
+
+	var changes []FieldChange
+	for _, field := range fields {
+		if !jsonEqual(oldFields[field], newFields[field]) {
+			changes = append(changes, FieldChange{field, oldFields[field], newFields[field]})
+		}
+	}
+
+	return changes, nil
+}
+
+// Compare two JSON values ignoring insignificant whitespace
+func jsonEqual(a json.RawMessage, b json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func hashRecord(line []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(line)
+	return h.Sum64()
+}
+
+//---------------------------------------------------------------------------------------
+
+// Scan an entity data file calling fn with the ID, byte offset and raw line
+// of each record, blank lines are skipped
+func scanDataFile(path string, fn func(id int64, offset int64, line []byte) error) error {
+	rf, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open the entity data file: %w", err)
+	}
+	defer func() { _ = rf.Close() }()
+
+	r := bufio.NewScanner(rf)
+	r.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	r.Split(bufio.ScanLines)
+
+	var offset int64 = 0
+	for r.Scan() {
+		line := r.Bytes()
+		lineOffset := offset
+		offset += int64(len(line)) + 1
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var record struct {
+			Id int64 `json:"id"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal the entity JSON data in %s: %w", path, err)
+		}
+		if err := fn(record.Id, lineOffset, line); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return fmt.Errorf("failed reading %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffData(t *testing.T) {
+	dir := t.TempDir()
+	writePartition(t, dir, "2024-05-01", map[string]string{
+		"movie.json": `{"id":1,"title":"A","runtime":90,"genres":[{"id":18}]}` + "\n" +
+			`{"id":2,"title":"B"}` + "\n" +
+			`{"id":3,"title":"C","tagline":"old"}` + "\n",
+	})
+	writePartition(t, dir, "2024-05-02", map[string]string{
+		"movie.json": `{"id":3,"title":"C"}` + "\n" +
+			`{"id":1,"title":"A","runtime":91,"genres":[ {"id":18} ]}` + "\n" +
+			`{"id":4,"title":"D"}` + "\n",
+		"movie_ids.json": `{"id":1}` + "\n" + `{"id":3}` + "\n" + `{"id":4}` + "\n",
+	})
+
+	from, err := FindPartition(dir, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("FindPartition() error = %v", err)
+	}
+	to, err := FindPartition(dir, time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("FindPartition() error = %v", err)
+	}
+
+	diffPath := filepath.Join(dir, "diff")
+	summary, err := DiffData(from, to, diffPath, Entities)
+	if err != nil {
+		t.Fatalf("DiffData() error = %v", err)
+	}
+
+	if got, want := *summary["Movie"], (DiffSummary{Inserted: 1, Updated: 2, Deleted: 1}); got != want {
+		t.Errorf("Movie summary = %+v, want %+v", got, want)
+	}
+	if _, ok := summary["Person"]; ok {
+		t.Error("expected the missing Person data to be skipped")
+	}
+
+	events := map[int64]ChangeEvent{}
+	for _, line := range readLines(t, filepath.Join(diffPath, "movie.json")) {
+		var event ChangeEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid change event %q: %v", line, err)
+		}
+		events[event.Id] = event
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %d change events, want 4", len(events))
+	}
+
+	// Whitespace inside an unchanged field is not reported as a change
+	if got := events[1]; got.Op != "update" || len(got.Changes) != 1 ||
+		got.Changes[0].Field != "runtime" || string(got.Changes[0].Old) != "90" || string(got.Changes[0].New) != "91" {
+		t.Errorf("event 1 = %+v", got)
+	}
+	if got := events[3]; got.Op != "update" || len(got.Changes) != 1 ||
+		got.Changes[0].Field != "tagline" || string(got.Changes[0].Old) != `"old"` || string(got.Changes[0].New) != "null" {
+		t.Errorf("event 3 = %+v", got)
+	}
+	if got := events[4]; got.Op != "insert" || string(got.Record) != `{"id":4,"title":"D"}` {
+		t.Errorf("event 4 = %+v", got)
+	}
+	if got := events[2]; got.Op != "delete" || string(got.Record) != `{"id":2,"title":"B"}` {
+		t.Errorf("event 2 = %+v", got)
+	}
+}
+
+func TestDiffDataUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	data := `{"id":1,"title":"A"}` + "\n" + `{"id":2,"title":"B"}` + "\n"
+	from := Partition{Path: writePartition(t, dir, "2024-05-01", map[string]string{"keyword.json": data})}
+	to := Partition{Path: writePartition(t, dir, "2024-05-02", map[string]string{"keyword.json": data, "keyword_ids.json": data})}
+
+	diffPath := filepath.Join(dir, "diff")
+	summary, err := DiffData(from, to, diffPath, []string{"Keyword"})
+	if err != nil {
+		t.Fatalf("DiffData() error = %v", err)
+	}
+
+	if got, want := *summary["Keyword"], (DiffSummary{Unchanged: 2}); got != want {
+		t.Errorf("Keyword summary = %+v, want %+v", got, want)
+	}
+	if got := readLines(t, filepath.Join(diffPath, "keyword.json")); len(got) != 0 {
+		t.Errorf("expected no change events, got %v", got)
+	}
+}
+
+func TestDiffDataKeepsFailedRecords(t *testing.T) {
+	dir := t.TempDir()
+	from := Partition{Path: writePartition(t, dir, "2024-05-01", map[string]string{
+		"keyword.json": `{"id":1,"name":"A"}` + "\n" + `{"id":2,"name":"B"}` + "\n",
+	})}
+
+	// The request for 2 failed, so it is still listed but has no record
+	to := Partition{Path: writePartition(t, dir, "2024-05-02", map[string]string{
+		"keyword.json":     `{"id":1,"name":"A"}` + "\n",
+		"keyword_ids.json": `{"id":1}` + "\n" + `{"id":2}` + "\n",
+	})}
+
+	diffPath := filepath.Join(dir, "diff")
+	summary, err := DiffData(from, to, diffPath, []string{"Keyword"})
+	if err != nil {
+		t.Fatalf("DiffData() error = %v", err)
+	}
+	if got, want := *summary["Keyword"], (DiffSummary{Unchanged: 1}); got != want {
+		t.Errorf("Keyword summary = %+v, want %+v", got, want)
+	}
+	if got := readLines(t, filepath.Join(diffPath, "keyword.json")); len(got) != 0 {
+		t.Errorf("expected no change events, got %v", got)
+	}
+}
+
+func TestDiffDataSkipsIncomplete(t *testing.T) {
+	dir := t.TempDir()
+	data := `{"id":1,"name":"A"}` + "\n"
+	from := Partition{Path: writePartition(t, dir, "2024-05-01", map[string]string{"keyword.json": data})}
+	to := Partition{Path: writePartition(t, dir, "2024-05-02", map[string]string{
+		"keyword.json":     data,
+		"keyword_ids.json": data,
+		"progress.json":    `{"Keyword":{"timed_out":true}}`,
+	})}
+
+	summary, err := DiffData(from, to, filepath.Join(dir, "diff"), []string{"Keyword"})
+	if err != nil {
+		t.Fatalf("DiffData() error = %v", err)
+	}
+	if _, ok := summary["Keyword"]; ok {
+		t.Error("expected the timed out Keyword export to be skipped")
+	}
+}
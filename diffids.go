@@ -0,0 +1,196 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Counts of the IDs added and removed between two Daily Export ID files
+type IDDiffSummary struct {
+	FromCount int64 `json:"from_count"`
+	ToCount   int64 `json:"to_count"`
+	Added     int64 `json:"added"`
+	Removed   int64 `json:"removed"`
+}
+
+//---------------------------------------------------------------------------------------
+
+// Compare the Daily Export ID files of two partitions and write, for each
+// entity, the ID records added in the newer partition to added.json and the
+// ID records removed from the older partition to removed.json, along with a
+// summary.json of the counts
+func DiffIDs(from Partition, to Partition, diffPath string, entities []string) (map[string]*IDDiffSummary, error) {
+
+	logger.Info().Msg("Initiating Diff of Daily Export IDs")
+
+	if err := os.MkdirAll(diffPath, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the diff path: %w", err)
+	}
+
+	dailyExports := NewDailyExports()
+	summary := map[string]*IDDiffSummary{}
+
+	for _, entity := range entities {
+		dailyExport := dailyExports[entity]
+		fromFile := filepath.Join(from.Path, dailyExport.Name)
+		toFile := filepath.Join(to.Path, dailyExport.Name)
+
+		if !fileExists(fromFile) || !fileExists(toFile) {
+			logger.Warn().Str("entity", entity).Msg("Daily Export IDs Missing, Skipping")
+			continue
+		}
+
+		entityPath := filepath.Join(diffPath, entityFileName(entity))
+		if err := os.MkdirAll(entityPath, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create the diff path: %w", err)
+		}
+
+		s, err := diffIDFiles(fromFile, toFile, entityPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s diff failed: %w", entity, err)
+		}
+		summary[entity] = s
+
+		logger.Info().Str("entity", entity).Int64("added", s.Added).Int64("removed", s.Removed).Msg(indent)
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the diff summary: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(diffPath, "summary.json"), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write the diff summary: %w", err)
+	}
+
+	return summary, nil
+}
+
+// Diff a pair of Daily Export ID files, only the sets of IDs are held in
+// memory, the records themselves are streamed from the files
+func diffIDFiles(fromFile string, toFile string, entityPath string) (*IDDiffSummary, error) {
+	summary := new(IDDiffSummary)
+
+	fromIDs := map[int64]struct{}{}
+	if err := scanIDFile(fromFile, func(id int64, line []byte) error {
+		fromIDs[id] = struct{}{}
+		summary.FromCount++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Anything in the newer file not seen in the older file was added
+	toIDs := map[int64]struct{}{}
+	err := writeLines(filepath.Join(entityPath, "added.json"), func(w *bufio.Writer) error {
+		return scanIDFile(toFile, func(id int64, line []byte) error {
+			toIDs[id] = struct{}{}
+			summary.ToCount++
+			if _, ok := fromIDs[id]; ok {
+				return nil
+			}
+			summary.Added++
+			return writeLine(w, line)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything in the older file not seen in the newer file was removed
+	err = writeLines(filepath.Join(entityPath, "removed.json"), func(w *bufio.Writer) error {
+		return scanIDFile(fromFile, func(id int64, line []byte) error {
+			if _, ok := toIDs[id]; ok {
+				return nil
+			}
+			summary.Removed++
+			return writeLine(w, line)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+// Scan a Daily Export ID file calling fn with the ID and raw line of each record
+func scanIDFile(path string, fn func(id int64, line []byte) error) error {
+	rf, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
+	}
+	defer func() { _ = rf.Close() }()
+
+	r := bufio.NewScanner(rf)
+	r.Split(bufio.ScanLines)
+
+	for r.Scan() {
+		var record struct {
+			Id int64 `json:"id"`
+		}
+		if err := json.Unmarshal(r.Bytes(), &record); err != nil {
+			return fmt.Errorf("failed to unmarshal the daily export JSON data in %s: %w", path, err)
+		}
+		if err := fn(record.Id, r.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return fmt.Errorf("failed reading %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Create the file and write to it through a buffered writer
+func writeLines(path string, fn func(w *bufio.Writer) error) error {
+	wf, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to open the output file: %w", err)
+	}
+	defer func() { _ = wf.Close() }()
+
+	w := bufio.NewWriter(wf)
+	if err := fn(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed writing to the output file: %w", err)
+	}
+
+	return wf.Close()
+}
+
+func writeLine(w *bufio.Writer, line []byte) error {
+	if _, err := w.Write(line); err != nil {
+		return fmt.Errorf("failed writing to the output file: %w", err)
+	}
+	if err := w.WriteByte('\n'); err != nil {
+		return fmt.Errorf("failed writing to the output file: %w", err)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
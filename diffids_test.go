@@ -0,0 +1,101 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffIDs(t *testing.T) {
+	dir := t.TempDir()
+	writePartition(t, dir, "2024-05-01", map[string]string{
+		"movie_ids.json":   `{"id":1,"original_title":"A"}` + "\n" + `{"id":2,"original_title":"B"}` + "\n" + `{"id":3,"original_title":"C"}` + "\n",
+		"keyword_ids.json": `{"id":9,"name":"K"}` + "\n",
+	})
+	writePartition(t, dir, "2024-05-02", map[string]string{
+		"movie_ids.json":   `{"id":3,"original_title":"C"}` + "\n" + `{"id":1,"original_title":"A"}` + "\n" + `{"id":4,"original_title":"D"}` + "\n",
+		"keyword_ids.json": `{"id":9,"name":"K"}` + "\n",
+	})
+
+	from, err := FindPartition(dir, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("FindPartition() error = %v", err)
+	}
+	to, err := FindPartition(dir, time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("FindPartition() error = %v", err)
+	}
+
+	diffPath := filepath.Join(dir, "diff")
+	summary, err := DiffIDs(from, to, diffPath, Entities)
+	if err != nil {
+		t.Fatalf("DiffIDs() error = %v", err)
+	}
+
+	if got, want := *summary["Movie"], (IDDiffSummary{3, 3, 1, 1}); got != want {
+		t.Errorf("Movie summary = %+v, want %+v", got, want)
+	}
+	if got, want := *summary["Keyword"], (IDDiffSummary{1, 1, 0, 0}); got != want {
+		t.Errorf("Keyword summary = %+v, want %+v", got, want)
+	}
+	if _, ok := summary["Person"]; ok {
+		t.Error("expected the missing Person IDs to be skipped")
+	}
+
+	if got := readLines(t, filepath.Join(diffPath, "movie", "added.json")); len(got) != 1 || got[0] != `{"id":4,"original_title":"D"}` {
+		t.Errorf("added.json = %v", got)
+	}
+	if got := readLines(t, filepath.Join(diffPath, "movie", "removed.json")); len(got) != 1 || got[0] != `{"id":2,"original_title":"B"}` {
+		t.Errorf("removed.json = %v", got)
+	}
+
+	data, err := os.ReadFile(filepath.Join(diffPath, "summary.json"))
+	if err != nil {
+		t.Fatalf("summary.json was not written: %v", err)
+	}
+	var written map[string]IDDiffSummary
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("invalid summary.json: %v", err)
+	}
+	if written["Movie"] != *summary["Movie"] {
+		t.Errorf("summary.json Movie = %+v, want %+v", written["Movie"], *summary["Movie"])
+	}
+}
+
+func TestDiffIDsAllMissing(t *testing.T) {
+	dir := t.TempDir()
+	from := writePartition(t, dir, "2024-05-01", map[string]string{})
+	to := writePartition(t, dir, "2024-05-02", map[string]string{})
+	diffPath := filepath.Join(dir, "diff")
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	summary, err := DiffIDs(Partition{day, from}, Partition{day.AddDate(0, 0, 1), to}, diffPath, []string{"Movie"})
+	if err != nil {
+		t.Fatalf("DiffIDs() error = %v", err)
+	}
+	if len(summary) != 0 || !fileExists(filepath.Join(diffPath, "summary.json")) {
+		t.Errorf("summary = %v, want an empty summary.json", summary)
+	}
+}
+
+func TestFindPartitionMissing(t *testing.T) {
+	if _, err := FindPartition(t.TempDir(), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("FindPartition() expected an error for a missing partition")
+	}
+}
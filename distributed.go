@@ -0,0 +1,556 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+)
+
+// Lease of a chunk of IDs of a single entity, handed to a remote worker until
+// it expires
+type Lease struct {
+	LeaseID string    `json:"lease_id"`
+	Entity  string    `json:"entity"`
+	Path    string    `json:"path"`
+	IDs     []int64   `json:"ids"`
+	Expires time.Time `json:"expires"`
+}
+
+type LeaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+// The records fetched by a remote worker for a lease, failed requests are
+// only counted
+type LeaseResult struct {
+	LeaseID string            `json:"lease_id"`
+	Worker  string            `json:"worker"`
+	Records []json.RawMessage `json:"records"`
+	Failed  int64             `json:"failed"`
+}
+
+type LeaseAck struct {
+	Accepted bool `json:"accepted"`
+}
+
+type CoordinatorStatus struct {
+	Chunks     int                        `json:"chunks"`
+	Completed  int                        `json:"completed"`
+	Leased     int                        `json:"leased"`
+	Reassigned int64                      `json:"reassigned"`
+	Progress   map[string]*ExportProgress `json:"progress"`
+}
+
+// Coordinator of a Distributed Crawl.  The Daily Export IDs are split into
+// chunks which are leased to remote workers over HTTP/JSON, a lease not
+// completed before it expires is handed to the next worker to ask, and the
+// first completion of each chunk is written to the entity data file.  Given a
+// Token, every request must carry it as a bearer token.
+//
+//	POST /lease     LeaseRequest -> 200 Lease, 204 none free yet, 410 complete
+//	POST /complete  LeaseResult  -> 200 LeaseAck, 400 record not leased, 404 unknown lease
+//	GET  /status    CoordinatorStatus
+type Coordinator struct {
+	LeaseTimeout time.Duration
+	Token        string
+
+	mux        *http.ServeMux
+	mu         sync.Mutex
+	chunks     []*leaseChunk
+	first      int
+	leases     map[string]*leaseChunk
+	outputs    map[string]*coordinatorOutput
+	completed  int
+	reassigned int64
+	err        error
+	done       chan struct{}
+}
+
+type leaseChunk struct {
+	entity  string
+	ids     []int64
+	leaseID string
+	expires time.Time
+	done    bool
+}
+
+type coordinatorOutput struct {
+	wf       *os.File
+	w        *bufio.Writer
+	progress *ExportProgress
+}
+
+// Number of consecutive failed requests to the coordinator before a worker
+// gives up
+const maxCoordinatorFailures = 5
+
+//---------------------------------------------------------------------------------------
+
+// Return a New Coordinator for the entities, reading their Daily Export ID
+// files, which must already be downloaded, into chunks of the lease size
+func NewCoordinator(tmdb *TheMovieDB, entities []string, leaseSize int, leaseTimeout time.Duration) (*Coordinator, error) {
+	c := &Coordinator{
+		LeaseTimeout: leaseTimeout,
+		mux:          http.NewServeMux(),
+		leases:       map[string]*leaseChunk{},
+		outputs:      map[string]*coordinatorOutput{},
+		done:         make(chan struct{}),
+	}
+	c.mux.HandleFunc("POST /lease", c.handleLease)
+	c.mux.HandleFunc("POST /complete", c.handleComplete)
+	c.mux.HandleFunc("GET /status", c.handleStatus)
+
+	for _, entity := range entities {
+		dailyExport := tmdb.DailyExports[entity]
+		progress := new(ExportProgress)
+		dailyExport.Progress = progress
+
+		var chunk *leaseChunk
+		err := scanIDFile(dailyExport.ExportFile, func(id int64, line []byte) error {
+			if chunk == nil || len(chunk.ids) >= leaseSize {
+				chunk = &leaseChunk{entity: entity}
+				c.chunks = append(c.chunks, chunk)
+			}
+			chunk.ids = append(chunk.ids, id)
+			progress.IDsRead++
+			return nil
+		})
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+
+		wf, err := os.Create(dailyExport.DataFile)
+		if err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("failed to open the output file: %w", err)
+		}
+		c.outputs[entity] = &coordinatorOutput{wf, bufio.NewWriter(wf), progress}
+
+		logger.Info().Str("entity", entity).Int64("ids", progress.IDsRead).Msg(indent)
+	}
+
+	if len(c.chunks) == 0 {
+		close(c.done)
+	}
+
+	return c, nil
+}
+
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.Token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	c.mux.ServeHTTP(w, r)
+}
+
+// Return a channel closed once every chunk has been completed
+func (c *Coordinator) Done() <-chan struct{} {
+	return c.done
+}
+
+// Flush and Close the entity data files
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for entity, output := range c.outputs {
+		if err := output.w.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("%s failed writing to the output file: %w", entity, err))
+		}
+		if err := output.wf.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			errs = append(errs, fmt.Errorf("%s failed closing the output file: %w", entity, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Serve the Coordinator on the address until every chunk has been completed,
+// lingering so polling workers learn the crawl is complete, or the context is
+// done
+func (c *Coordinator) Serve(ctx context.Context, addr string, linger time.Duration) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to listen on %s: %w", addr, err), c.Close())
+	}
+	server := &http.Server{Handler: c}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(ln) }()
+	logger.Info().Str("Coordinator Listening On", ln.Addr().String()).Msg(indent)
+
+	select {
+	case <-c.done:
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+		if err != nil {
+			break
+		}
+		logger.Info().Msg("All Leases Completed")
+		select {
+		case <-time.After(linger):
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+		err = fmt.Errorf("coordinator interrupted: %w", ctx.Err())
+	case err = <-errs:
+		err = fmt.Errorf("coordinator failed: %w", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	_ = server.Shutdown(shutdownCtx)
+
+	return errors.Join(err, c.Close())
+}
+
+//---------------------------------------------------------------------------------------
+
+func (c *Coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	var req LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid lease request", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	lease, complete := c.lease(req.Worker)
+	c.mu.Unlock()
+
+	switch {
+	case lease != nil:
+		writeJSON(w, lease)
+	case complete:
+		w.WriteHeader(http.StatusGone)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Lease the first chunk not completed and not already leased, or whose lease
+// has expired, reporting whether every chunk has been completed.  Lease IDs
+// are random, so a lease cannot be completed by a worker it was not handed to.
+func (c *Coordinator) lease(worker string) (*Lease, bool) {
+	if c.err != nil {
+		return nil, true
+	}
+
+	for c.first < len(c.chunks) && c.chunks[c.first].done {
+		c.first++
+	}
+
+	now := time.Now()
+	for _, chunk := range c.chunks[c.first:] {
+		if chunk.done || (chunk.leaseID != "" && now.Before(chunk.expires)) {
+			continue
+		}
+		if chunk.leaseID != "" {
+			logger.Warn().Str("lease", chunk.leaseID).Str("worker", worker).Msg("Lease Expired, Reassigning")
+			c.reassigned++
+		}
+
+		chunk.leaseID = rand.Text()
+		chunk.expires = now.Add(c.LeaseTimeout)
+		c.leases[chunk.leaseID] = chunk
+		logger.Debug().Str("lease", chunk.leaseID).Str("worker", worker).Str("entity", chunk.entity).Msg(indent)
+
+		return &Lease{chunk.leaseID, chunk.entity, entityAPIPaths[chunk.entity], chunk.ids, chunk.expires}, false
+	}
+
+	return nil, c.completed == len(c.chunks)
+}
+
+func (c *Coordinator) handleComplete(w http.ResponseWriter, r *http.Request) {
+	var result LeaseResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, "invalid lease result", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		http.Error(w, "coordinator failed", http.StatusServiceUnavailable)
+		return
+	}
+	chunk, ok := c.leases[result.LeaseID]
+	if !ok {
+		http.Error(w, "unknown lease", http.StatusNotFound)
+		return
+	}
+
+	// Only the first completion of a chunk is kept, a late completion of a
+	// reassigned lease is acknowledged but ignored
+	if chunk.done {
+		writeJSON(w, &LeaseAck{Accepted: false})
+		return
+	}
+
+	// Every record must be one of the IDs leased, and appear only once
+	lines, err := leaseLines(chunk, result.Records)
+	if err != nil {
+		logger.Warn().Err(err).Str("lease", result.LeaseID).Str("worker", result.Worker).Msg("Lease Result Rejected")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The chunk is written in one go, a failure leaves the data file part
+	// written, so the crawl is stopped rather than the chunk reassigned and
+	// its records written twice
+	output := c.outputs[chunk.entity]
+	if _, err := output.w.Write(lines); err != nil {
+		logger.Error().Err(err).Str("lease", result.LeaseID).Msg("Write Lease Result Failed")
+		chunk.done = true
+		c.err = fmt.Errorf("%s failed writing to the output file: %w", chunk.entity, err)
+		close(c.done)
+		http.Error(w, "failed to write the lease result", http.StatusInternalServerError)
+		return
+	}
+	output.progress.RecordsExported += int64(len(result.Records))
+	output.progress.Failed += result.Failed
+
+	chunk.done = true
+	c.completed++
+	logger.Debug().Str("lease", result.LeaseID).Str("worker", result.Worker).Int("records", len(result.Records)).Msg("Lease Completed")
+	if c.completed%100 == 0 {
+		logger.Info().Int("completed", c.completed).Int("total", len(c.chunks)).Msg(indent)
+	}
+	if c.completed == len(c.chunks) {
+		close(c.done)
+	}
+
+	writeJSON(w, &LeaseAck{Accepted: true})
+}
+
+// Return the records of the lease result as lines of the entity data file,
+// failing if a record is not one of the IDs leased or is repeated
+func leaseLines(chunk *leaseChunk, records []json.RawMessage) ([]byte, error) {
+	leased := make(map[int64]bool, len(chunk.ids))
+	for _, id := range chunk.ids {
+		leased[id] = true
+	}
+
+	var b bytes.Buffer
+	for _, record := range records {
+		var r struct {
+			Id int64 `json:"id"`
+		}
+		if err := json.Unmarshal(record, &r); err != nil {
+			return nil, fmt.Errorf("invalid record: %w", err)
+		}
+		if !leased[r.Id] {
+			return nil, fmt.Errorf("record %d is not in the lease or is repeated", r.Id)
+		}
+		leased[r.Id] = false
+
+		if err := json.Compact(&b, record); err != nil {
+			return nil, fmt.Errorf("invalid record %d: %w", r.Id, err)
+		}
+		b.WriteByte('\n')
+	}
+
+	return b.Bytes(), nil
+}
+
+func (c *Coordinator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := &CoordinatorStatus{
+		Chunks:     len(c.chunks),
+		Completed:  c.completed,
+		Reassigned: c.reassigned,
+		Progress:   map[string]*ExportProgress{},
+	}
+	now := time.Now()
+	for _, chunk := range c.chunks {
+		if !chunk.done && chunk.leaseID != "" && now.Before(chunk.expires) {
+			status.Leased++
+		}
+	}
+	for entity, output := range c.outputs {
+		status.Progress[entity] = output.progress
+	}
+
+	writeJSON(w, status)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error().Err(err).Msg("Write Response Failed")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+// Lease chunks of IDs from the Coordinator and fetch them with the Worker
+// Pool until the crawl is complete.  A lease interrupted part way is not
+// completed, it expires and is handed to another worker.
+func RunWorker(ctx context.Context, coordinatorURL string, token string, name string, pool *WorkerPool, pollInterval time.Duration) error {
+	var completed int64
+	var failures int
+
+	for {
+		lease, complete, err := requestLease(ctx, coordinatorURL, token, name)
+		switch {
+		case ctx.Err() != nil:
+			return fmt.Errorf("worker interrupted: %w", ctx.Err())
+		case err != nil:
+			failures++
+			if failures >= maxCoordinatorFailures {
+				return fmt.Errorf("coordinator unavailable: %w", err)
+			}
+			logger.Warn().Err(err).Msg("Lease Request Failed")
+			sleepContext(ctx, pollInterval)
+			continue
+		case complete:
+			logger.Info().Int64("Leases Completed", completed).Msg(indent)
+			return nil
+		case lease == nil:
+			failures = 0
+			sleepContext(ctx, pollInterval)
+			continue
+		}
+		failures = 0
+
+		result, err := fetchLease(ctx, pool, name, lease)
+		if err != nil {
+			return err
+		}
+
+		accepted, err := completeLease(ctx, coordinatorURL, token, result)
+		if err != nil {
+			logger.Error().Err(err).Str("lease", lease.LeaseID).Msg("Lease Completion Failed")
+			continue
+		}
+		if !accepted {
+			logger.Warn().Str("lease", lease.LeaseID).Msg("Lease Already Completed by Another Worker")
+		}
+		completed++
+	}
+}
+
+// Fetch every ID of the lease, failing if the context is done part way
+func fetchLease(ctx context.Context, pool *WorkerPool, name string, lease *Lease) (*LeaseResult, error) {
+	result := &LeaseResult{LeaseID: lease.LeaseID, Worker: name}
+
+	results := make(chan *RequestResult, len(lease.IDs))
+	var submitted int
+	for _, id := range lease.IDs {
+		job := &RequestJob{Ctx: ctx, Entity: lease.Entity, Id: id, Path: lease.Path, Results: results}
+		if err := pool.Submit(ctx, job); err != nil {
+			break
+		}
+		submitted++
+	}
+
+	for range submitted {
+		r := <-results
+		switch {
+		case r == nil:
+		case r.Err != nil || !json.Valid([]byte(r.Response)):
+			result.Failed++
+		default:
+			result.Records = append(result.Records, json.RawMessage(r.Response))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("lease %s interrupted: %w", lease.LeaseID, err)
+	}
+
+	return result, nil
+}
+
+// Request a Lease, returning nil if none is free yet and true once the crawl
+// is complete
+func requestLease(ctx context.Context, coordinatorURL string, token string, name string) (*Lease, bool, error) {
+	var lease *Lease
+	var complete bool
+
+	err := coordinatorRequest(coordinatorURL, token).
+		Path("/lease").
+		BodyJSON(&LeaseRequest{Worker: name}).
+		CheckStatus(http.StatusOK, http.StatusNoContent, http.StatusGone).
+		Handle(func(res *http.Response) error {
+			switch res.StatusCode {
+			case http.StatusGone:
+				complete = true
+			case http.StatusOK:
+				lease = new(Lease)
+				return json.NewDecoder(res.Body).Decode(lease)
+			}
+			return nil
+		}).
+		Fetch(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return lease, complete, nil
+}
+
+// Complete a Lease, returning whether the result was accepted
+func completeLease(ctx context.Context, coordinatorURL string, token string, result *LeaseResult) (bool, error) {
+	var ack LeaseAck
+
+	err := coordinatorRequest(coordinatorURL, token).
+		Path("/complete").
+		BodyJSON(result).
+		ToJSON(&ack).
+		Fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return ack.Accepted, nil
+}
+
+// Return a Request to the Coordinator, carrying the token if any
+func coordinatorRequest(coordinatorURL string, token string) *requests.Builder {
+	rb := requests.URL(coordinatorURL)
+	if token != "" {
+		rb.Bearer(token)
+	}
+	return rb
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
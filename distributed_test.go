@@ -0,0 +1,259 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDistributedCrawl(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(25)
+	f.status = func(path string, attempt int) int {
+		if path == "/3/movie/13" {
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	}
+
+	tmdb := newTestMovieDB(t, f)
+	coordinator, err := NewCoordinator(tmdb, []string{"Movie", "Keyword"}, 4, time.Minute)
+	if err != nil {
+		t.Fatalf("NewCoordinator() error = %v", err)
+	}
+	server := httptest.NewServer(coordinator)
+	t.Cleanup(server.Close)
+
+	// Several workers share the leases between them
+	errs := make(chan error, 3)
+	for num := range 3 {
+		pool := NewWorkerPool(2, 0, nil, f.URL, "test-key", time.Second)
+		t.Cleanup(pool.Close)
+		go func() {
+			errs <- RunWorker(t.Context(), server.URL, "", fmt.Sprintf("worker-%d", num), pool, 10*time.Millisecond)
+		}()
+	}
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Fatalf("RunWorker() error = %v", err)
+		}
+	}
+
+	select {
+	case <-coordinator.Done():
+	default:
+		t.Fatal("expected the coordinator to be done")
+	}
+	if err := coordinator.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	var want []int64
+	for id := int64(1); id <= 25; id++ {
+		if id != 13 {
+			want = append(want, id)
+		}
+	}
+	if got := readIDs(t, tmdb.DailyExports["Movie"].DataFile); !slices.Equal(got, want) {
+		t.Errorf("movie IDs = %v, want %v", got, want)
+	}
+	if got := readIDs(t, tmdb.DailyExports["Keyword"].DataFile); len(got) != 25 {
+		t.Errorf("exported %d keywords, want 25", len(got))
+	}
+	if progress := tmdb.DailyExports["Movie"].Progress; progress.IDsRead != 25 || progress.RecordsExported != 24 || progress.Failed != 1 {
+		t.Errorf("Movie progress = %+v", *progress)
+	}
+}
+
+func TestCoordinatorLeaseExpiry(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(3)
+
+	tmdb := newTestMovieDB(t, f)
+	coordinator, err := NewCoordinator(tmdb, []string{"Keyword"}, 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewCoordinator() error = %v", err)
+	}
+	server := httptest.NewServer(coordinator)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { _ = coordinator.Close() })
+
+	first, complete, err := requestLease(t.Context(), server.URL, "", "slow")
+	if err != nil || first == nil || complete {
+		t.Fatalf("requestLease() = %v, %v, %v", first, complete, err)
+	}
+	if !slices.Equal(first.IDs, []int64{1, 2, 3}) || first.Path != "/3/keyword/%d" {
+		t.Errorf("lease = %+v", first)
+	}
+
+	// No lease is free until the first one expires
+	if lease, complete, err := requestLease(t.Context(), server.URL, "", "fast"); err != nil || lease != nil || complete {
+		t.Fatalf("requestLease() = %v, %v, %v, want no lease", lease, complete, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	second, _, err := requestLease(t.Context(), server.URL, "", "fast")
+	if err != nil || second == nil || second.LeaseID == first.LeaseID || !slices.Equal(second.IDs, first.IDs) {
+		t.Fatalf("requestLease() = %+v, %v, want the reassigned lease", second, err)
+	}
+
+	// The first completion wins, the late one is ignored
+	records := []json.RawMessage{json.RawMessage(`{"id":1}`), json.RawMessage(`{"id":2}`), json.RawMessage(`{"id":3}`)}
+	if accepted, err := completeLease(t.Context(), server.URL, "", &LeaseResult{LeaseID: second.LeaseID, Records: records}); err != nil || !accepted {
+		t.Fatalf("completeLease(second) = %v, %v", accepted, err)
+	}
+	if accepted, err := completeLease(t.Context(), server.URL, "", &LeaseResult{LeaseID: first.LeaseID, Records: records}); err != nil || accepted {
+		t.Fatalf("completeLease(first) = %v, %v, want not accepted", accepted, err)
+	}
+	if _, err := completeLease(t.Context(), server.URL, "", &LeaseResult{LeaseID: "unknown"}); err == nil {
+		t.Error("completeLease() expected an error for an unknown lease")
+	}
+
+	if lease, complete, err := requestLease(t.Context(), server.URL, "", "fast"); err != nil || lease != nil || !complete {
+		t.Fatalf("requestLease() = %v, %v, %v, want complete", lease, complete, err)
+	}
+
+	var status CoordinatorStatus
+	res, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Chunks != 1 || status.Completed != 1 || status.Reassigned != 1 || status.Progress["Keyword"].RecordsExported != 3 {
+		t.Errorf("status = %+v", status)
+	}
+
+	if err := coordinator.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := readIDs(t, tmdb.DailyExports["Keyword"].DataFile); !slices.Equal(got, []int64{1, 2, 3}) {
+		t.Errorf("keyword IDs = %v", got)
+	}
+}
+
+func TestCoordinatorRejectsRecords(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(3)
+
+	tmdb := newTestMovieDB(t, f)
+	coordinator, err := NewCoordinator(tmdb, []string{"Keyword"}, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("NewCoordinator() error = %v", err)
+	}
+	server := httptest.NewServer(coordinator)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { _ = coordinator.Close() })
+
+	lease, _, err := requestLease(t.Context(), server.URL, "", "worker")
+	if err != nil || lease == nil {
+		t.Fatalf("requestLease() = %v, %v", lease, err)
+	}
+	if _, err := strconv.ParseInt(lease.LeaseID, 10, 64); err == nil {
+		t.Errorf("lease ID %s is sequential, want it random", lease.LeaseID)
+	}
+
+	// Records not in the lease, or repeated, are rejected and the lease kept
+	for _, records := range [][]json.RawMessage{
+		{json.RawMessage(`{"id":1}`), json.RawMessage(`{"id":99}`)},
+		{json.RawMessage(`{"id":1}`), json.RawMessage(`{"id":1}`)},
+	} {
+		if _, err := completeLease(t.Context(), server.URL, "", &LeaseResult{LeaseID: lease.LeaseID, Records: records}); err == nil {
+			t.Errorf("completeLease(%s) expected an error", records)
+		}
+	}
+	records := []json.RawMessage{json.RawMessage(`{"id":1}`), json.RawMessage("{\n  \"id\": 3\n}")}
+	if accepted, err := completeLease(t.Context(), server.URL, "", &LeaseResult{LeaseID: lease.LeaseID, Records: records, Failed: 1}); err != nil || !accepted {
+		t.Fatalf("completeLease() = %v, %v", accepted, err)
+	}
+
+	if err := coordinator.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := readLines(t, tmdb.DailyExports["Keyword"].DataFile); !slices.Equal(got, []string{`{"id":1}`, `{"id":3}`}) {
+		t.Errorf("keyword data file = %q", got)
+	}
+}
+
+func TestCoordinatorToken(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(3)
+
+	tmdb := newTestMovieDB(t, f)
+	coordinator, err := NewCoordinator(tmdb, []string{"Keyword"}, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("NewCoordinator() error = %v", err)
+	}
+	coordinator.Token = "secret"
+	server := httptest.NewServer(coordinator)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { _ = coordinator.Close() })
+
+	for _, token := range []string{"", "wrong"} {
+		if _, _, err := requestLease(t.Context(), server.URL, token, "worker"); err == nil {
+			t.Errorf("requestLease(%q) expected an error", token)
+		}
+	}
+	if lease, _, err := requestLease(t.Context(), server.URL, "secret", "worker"); err != nil || lease == nil {
+		t.Errorf("requestLease() = %v, %v", lease, err)
+	}
+}
+
+func TestCoordinatorWriteFailure(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(4)
+
+	tmdb := newTestMovieDB(t, f)
+	coordinator, err := NewCoordinator(tmdb, []string{"Keyword"}, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("NewCoordinator() error = %v", err)
+	}
+	server := httptest.NewServer(coordinator)
+	t.Cleanup(server.Close)
+
+	// Fail every write to the data file
+	output := coordinator.outputs["Keyword"]
+	_ = output.wf.Close()
+	output.w = bufio.NewWriterSize(output.wf, 16)
+
+	lease, _, err := requestLease(t.Context(), server.URL, "", "worker")
+	if err != nil || lease == nil {
+		t.Fatalf("requestLease() = %v, %v", lease, err)
+	}
+	records := []json.RawMessage{json.RawMessage(`{"id":1,"name":"first"}`), json.RawMessage(`{"id":2,"name":"second"}`)}
+	if _, err := completeLease(t.Context(), server.URL, "", &LeaseResult{LeaseID: lease.LeaseID, Records: records}); err == nil {
+		t.Fatal("completeLease() expected an error when the write fails")
+	}
+
+	// The crawl stops rather than reassigning the part written chunk
+	select {
+	case <-coordinator.Done():
+	default:
+		t.Fatal("expected the coordinator to be done")
+	}
+	if lease, complete, err := requestLease(t.Context(), server.URL, "", "worker"); err != nil || lease != nil || !complete {
+		t.Errorf("requestLease() = %v, %v, %v, want no more leases", lease, complete, err)
+	}
+}
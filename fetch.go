@@ -0,0 +1,169 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//---------------------------------------------------------------------------------------
+
+// Parse a list of IDs, one or more per line separated by commas or spaces.
+// Lines holding a JSON object, such as a Daily Export ID record, are read
+// for their id field and blank lines or lines starting with # are ignored.
+func ParseIDList(r io.Reader) ([]int64, error) {
+	var ids []int64
+
+	s := bufio.NewScanner(r)
+	s.Split(bufio.ScanLines)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '{' {
+			var record struct {
+				Id int64 `json:"id"`
+			}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal the ID JSON data: %w", err)
+			}
+			ids = append(ids, record.Id)
+			continue
+		}
+
+		for _, field := range strings.FieldsFunc(string(line), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			id, err := strconv.ParseInt(field, 10, 64)
+			if err != nil || id < 1 {
+				return nil, fmt.Errorf("invalid ID %q, expected a positive integer", field)
+			}
+			ids = append(ids, id)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading the ID list: %w", err)
+	}
+
+	return ids, nil
+}
+
+// Use an explicit list of IDs for the entity in place of its Daily ID
+// Export.  The IDs are written to an ID file in the Output Path, which
+// must already be set, and the entity data and progress alongside it.  The
+// files are prefixed by fetch_, so fetching into a partition never touches
+// the files of the daily crawl, and an earlier fetch is never overwritten.
+func (tmdb *TheMovieDB) SetIDList(entity string, ids []int64) error {
+	dailyExport, ok := tmdb.DailyExports[entity]
+	if !ok {
+		return fmt.Errorf("unknown entity %s", entity)
+	}
+
+	name := filepath.Join(tmdb.OutputPath, "fetch_"+entityFileName(entity))
+	dailyExport.ExportFile = name + "_ids.json"
+	dailyExport.DataFile = name + ".json"
+	tmdb.progressFile = name + "_progress.json"
+
+	for _, path := range []string{dailyExport.ExportFile, dailyExport.DataFile, tmdb.progressFile} {
+		if fileExists(path) {
+			return fmt.Errorf("%s already exists, refusing to overwrite an earlier fetch", path)
+		}
+	}
+
+	return writeLines(dailyExport.ExportFile, func(w *bufio.Writer) error {
+		for _, id := range ids {
+			if _, err := fmt.Fprintf(w, "{\"id\":%d}\n", id); err != nil {
+				return fmt.Errorf("failed writing to the output file: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Export the Data of the named entity
+func (tmdb *TheMovieDB) ExportEntityData(ctx context.Context, entity string) error {
+	exports := map[string]func(context.Context) error{
+		"Movie":      tmdb.ExportMovieData,
+		"TV Series":  tmdb.ExportTVSeriesData,
+		"Person":     tmdb.ExportPersonData,
+		"Collection": tmdb.ExportCollectionData,
+		"TV Network": tmdb.ExportTVNetworkData,
+		"Keyword":    tmdb.ExportKeywordData,
+		"Company":    tmdb.ExportCompanyData,
+	}
+
+	export, ok := exports[entity]
+	if !ok {
+		return fmt.Errorf("unknown entity %s", entity)
+	}
+
+	return export(ctx)
+}
+
+//---------------------------------------------------------------------------------------
+
+// Read the ID list from a file, or stdin when the path is -, followed by any
+// comma separated IDs given directly, dropping duplicates
+func readIDList(path string, list string) ([]int64, error) {
+	var ids []int64
+
+	if path != "" {
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			rf, err := os.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open the ID list file: %w", err)
+			}
+			defer func() { _ = rf.Close() }()
+			r = rf
+		}
+
+		fromFile, err := ParseIDList(r)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, fromFile...)
+	}
+
+	if list != "" {
+		fromList, err := ParseIDList(strings.NewReader(list))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, fromList...)
+	}
+
+	// Only fetch each ID once, keeping the order they were given in
+	seen := map[int64]bool{}
+	ids = slices.DeleteFunc(ids, func(id int64) bool {
+		if seen[id] {
+			return true
+		}
+		seen[id] = true
+		return false
+	})
+
+	return ids, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseIDList(t *testing.T) {
+	input := "# curated list\n550, 551\n\n603 604\n" + `{"adult":false,"id":13,"popularity":1.5}` + "\n"
+
+	got, err := ParseIDList(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseIDList() error = %v", err)
+	}
+	if want := []int64{550, 551, 603, 604, 13}; !slices.Equal(got, want) {
+		t.Errorf("ParseIDList() = %v, want %v", got, want)
+	}
+
+	for _, input := range []string{"550,abc", "-1", "{bad json}"} {
+		if _, err := ParseIDList(strings.NewReader(input)); err == nil {
+			t.Errorf("ParseIDList(%q) expected an error", input)
+		}
+	}
+}
+
+func TestReadIDList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids.txt")
+	if err := os.WriteFile(path, []byte("3\n1\n3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readIDList(path, "2,1")
+	if err != nil {
+		t.Fatalf("readIDList() error = %v", err)
+	}
+	if want := []int64{3, 1, 2}; !slices.Equal(got, want) {
+		t.Errorf("readIDList() = %v, want %v", got, want)
+	}
+}
+
+func TestExportEntityDataIDList(t *testing.T) {
+	f := newFakeTMDB(t)
+
+	tmdb := testMovieDB(t)
+	tmdb.APIURL = f.URL
+	tmdb.OutputPath = t.TempDir()
+	t.Cleanup(tmdb.Close)
+
+	if err := tmdb.SetIDList("TV Series", []int64{42, 7}); err != nil {
+		t.Fatalf("SetIDList() error = %v", err)
+	}
+	if err := tmdb.ExportEntityData(t.Context(), "TV Series"); err != nil {
+		t.Fatalf("ExportEntityData() error = %v", err)
+	}
+
+	if got, want := readIDs(t, filepath.Join(tmdb.OutputPath, "fetch_tv_series.json")), []int64{7, 42}; !slices.Equal(got, want) {
+		t.Errorf("exported IDs = %v, want %v", got, want)
+	}
+	if err := tmdb.WriteProgress(); err != nil {
+		t.Fatalf("WriteProgress() error = %v", err)
+	}
+	if !fileExists(filepath.Join(tmdb.OutputPath, "fetch_tv_series_progress.json")) {
+		t.Error("fetch_tv_series_progress.json was not written")
+	}
+	if attempts := f.attemptsFor("/3/tv/42"); attempts != 1 {
+		t.Errorf("/3/tv/42 requested %d times, want 1", attempts)
+	}
+	if err := tmdb.ExportEntityData(t.Context(), "Film"); err == nil {
+		t.Error("ExportEntityData() expected an error for an unknown entity")
+	}
+}
+
+func TestSetIDListKeepsPartitionFiles(t *testing.T) {
+	tmdb := testMovieDB(t)
+	tmdb.OutputPath = writePartition(t, t.TempDir(), "2024-05-01", map[string]string{
+		"movie.json":     `{"id":1}` + "\n" + `{"id":2}` + "\n",
+		"movie_ids.json": `{"id":1}` + "\n" + `{"id":2}` + "\n",
+		"progress.json":  `{"Movie":{"records_exported":2}}`,
+	})
+
+	if err := tmdb.SetIDList("Movie", []int64{2}); err != nil {
+		t.Fatalf("SetIDList() error = %v", err)
+	}
+	if got := readLines(t, filepath.Join(tmdb.OutputPath, "movie_ids.json")); len(got) != 2 {
+		t.Errorf("movie_ids.json = %v, want the daily export IDs kept", got)
+	}
+	if got := readLines(t, filepath.Join(tmdb.OutputPath, "fetch_movie_ids.json")); len(got) != 1 {
+		t.Errorf("fetch_movie_ids.json = %v, want the one ID", got)
+	}
+
+	// A second fetch of the entity would overwrite the first
+	if err := tmdb.SetIDList("Movie", []int64{1}); err == nil {
+		t.Error("SetIDList() expected an error overwriting an earlier fetch")
+	}
+}
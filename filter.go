@@ -0,0 +1,187 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The fields of a Daily Export ID record used to decide whether it is crawled
+type ExportID struct {
+	Id         int64
+	Popularity float64
+	Adult      bool
+	Video      bool
+}
+
+// Filter applied to the Daily Export IDs as they are read, every term must
+// match for an ID to be crawled
+type IDFilter struct {
+	terms []filterTerm
+}
+
+type filterTerm struct {
+	field string
+	op    string
+	value float64
+}
+
+// The entities whose Daily Export ID records carry each filter field, a term
+// is ignored for entities without its field
+var filterFields = map[string][]string{
+	"popularity": {"Movie", "TV Series", "Person"},
+	"adult":      {"Movie", "Person"},
+	"video":      {"Movie"},
+}
+
+// Comparison operators, longest first so ">=" is not read as ">"
+var filterOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+//---------------------------------------------------------------------------------------
+
+// Parse a comma separated list of filter terms, e.g.
+// popularity>=1,adult=false,video=false
+func ParseFilter(spec string) (*IDFilter, error) {
+	filter := new(IDFilter)
+
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.ReplaceAll(term, " ", "")
+		if term == "" {
+			continue
+		}
+
+		var t filterTerm
+		for _, op := range filterOps {
+			if field, value, ok := strings.Cut(term, op); ok {
+				t = filterTerm{field: strings.ToLower(field), op: op}
+				if err := t.parseValue(value); err != nil {
+					return nil, fmt.Errorf("invalid filter %q: %w", term, err)
+				}
+				break
+			}
+		}
+		if t.op == "" {
+			return nil, fmt.Errorf("invalid filter %q, expected FIELD OP VALUE", term)
+		}
+		filter.terms = append(filter.terms, t)
+	}
+
+	if len(filter.terms) == 0 {
+		return nil, nil
+	}
+
+	return filter, nil
+}
+
+func (t *filterTerm) parseValue(value string) error {
+	switch t.field {
+	case "popularity":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number")
+		}
+		t.value = v
+	case "adult", "video":
+		if t.op != "=" && t.op != "!=" {
+			return fmt.Errorf("%s only supports = and !=", t.field)
+		}
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		if v {
+			t.value = 1
+		}
+	default:
+		return fmt.Errorf("unknown field %s, expected popularity, adult or video", t.field)
+	}
+
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+// Return true if the ID should be crawled, a nil filter matches everything
+func (filter *IDFilter) Match(entity string, id ExportID) bool {
+	if filter == nil {
+		return true
+	}
+
+	for _, t := range filter.terms {
+		if !slices.Contains(filterFields[t.field], entity) {
+			continue
+		}
+
+		var v float64
+		switch t.field {
+		case "popularity":
+			v = id.Popularity
+		case "adult":
+			v = boolValue(id.Adult)
+		case "video":
+			v = boolValue(id.Video)
+		}
+		if !compare(v, t.op, t.value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func compare(a float64, op string, b float64) bool {
+	switch op {
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	default:
+		return a == b
+	}
+}
+
+// Describe the filter for the log
+func (filter *IDFilter) String() string {
+	if filter == nil {
+		return ""
+	}
+
+	var terms []string
+	for _, t := range filter.terms {
+		value := strconv.FormatFloat(t.value, 'f', -1, 64)
+		if t.field != "popularity" {
+			value = strconv.FormatBool(t.value == 1)
+		}
+		terms = append(terms, t.field+t.op+value)
+	}
+
+	return strings.Join(terms, ",")
+}
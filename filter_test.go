@@ -0,0 +1,105 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter("Popularity >= 1.5, adult=false,video!=true,")
+	if err != nil {
+		t.Fatalf("ParseFilter() error = %v", err)
+	}
+	if got, want := filter.String(), "popularity>=1.5,adult=false,video!=true"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	if filter, err := ParseFilter(""); err != nil || filter != nil {
+		t.Errorf("ParseFilter(\"\") = %v, %v, want nil, nil", filter, err)
+	}
+
+	for _, spec := range []string{"popularity", "popularity>=x", "adult>=1", "adult=maybe", "rating>5"} {
+		if _, err := ParseFilter(spec); err == nil {
+			t.Errorf("ParseFilter(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestIDFilterMatch(t *testing.T) {
+	filter, err := ParseFilter("popularity>=1,adult=false,video=false")
+	if err != nil {
+		t.Fatalf("ParseFilter() error = %v", err)
+	}
+
+	tests := []struct {
+		entity string
+		id     ExportID
+		want   bool
+	}{
+		{"Movie", ExportID{Id: 1, Popularity: 2}, true},
+		{"Movie", ExportID{Id: 2, Popularity: 0.5}, false},
+		{"Movie", ExportID{Id: 3, Popularity: 2, Adult: true}, false},
+		{"Movie", ExportID{Id: 4, Popularity: 2, Video: true}, false},
+		{"TV Series", ExportID{Id: 5, Popularity: 0.5}, false},
+		{"Person", ExportID{Id: 6, Popularity: 2, Video: true}, true},
+		{"Keyword", ExportID{Id: 7}, true},
+	}
+	for _, tt := range tests {
+		if got := filter.Match(tt.entity, tt.id); got != tt.want {
+			t.Errorf("Match(%s, %+v) = %v, want %v", tt.entity, tt.id, got, tt.want)
+		}
+	}
+
+	var none *IDFilter
+	if !none.Match("Movie", ExportID{Id: 1}) {
+		t.Error("a nil filter should match everything")
+	}
+}
+
+func TestExportDataFiltered(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(10)
+
+	tmdb := newTestMovieDB(t, f)
+	filter, err := ParseFilter("popularity>=5")
+	if err != nil {
+		t.Fatalf("ParseFilter() error = %v", err)
+	}
+	tmdb.Filter = filter
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+	if got, want := readIDs(t, tmdb.DailyExports["Movie"].DataFile), []int64{5, 6, 7, 8, 9, 10}; !slices.Equal(got, want) {
+		t.Errorf("exported IDs = %v, want %v", got, want)
+	}
+	if attempts := f.attemptsFor("/3/movie/1"); attempts != 0 {
+		t.Errorf("filtered ID was requested %d times", attempts)
+	}
+	progress := tmdb.DailyExports["Movie"].Progress
+	if progress.IDsRead != 10 || progress.Filtered != 4 || progress.RecordsExported != 6 {
+		t.Errorf("progress = %+v", *progress)
+	}
+
+	// Keyword IDs carry no popularity so the filter does not apply
+	if err := tmdb.ExportKeywordData(t.Context()); err != nil {
+		t.Fatalf("ExportKeywordData() error = %v", err)
+	}
+	if got := readIDs(t, tmdb.DailyExports["Keyword"].DataFile); len(got) != 10 {
+		t.Errorf("exported %d keywords, want 10", len(got))
+	}
+}
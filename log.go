@@ -0,0 +1,100 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log Options shared by the crawl and every command.  The log is written to
+// stderr unless a log file is given, which is rotated once it reaches the
+// maximum size.
+type LogOptions struct {
+	Format     string
+	File       string
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+}
+
+// The format and destination of the current logger, so the progress display
+// can redirect a log written to stderr through itself
+var logFormat = "console"
+var logToStderr = true
+
+//---------------------------------------------------------------------------------------
+
+// Define the Log flags on the Flag Set
+func logFlags(fs *flag.FlagSet) *LogOptions {
+	opts := &LogOptions{Format: "console"}
+
+	fs.Func("logFormat", "Log Format, One of console or json  (default console)", func(value string) error {
+		if value != "console" && value != "json" {
+			return fmt.Errorf("expected console or json")
+		}
+		opts.Format = value
+		return nil
+	})
+	fs.StringVar(&opts.File, "logFile", "", "Write the Log to this File in place of stderr, Rotating it by Size")
+	fs.IntVar(&opts.MaxSize, "logMaxSize", 100, "Size in Megabytes at which the Log File is Rotated")
+	fs.IntVar(&opts.MaxBackups, "logMaxBackups", 10, "Number of Rotated Log Files Kept, 0 Keeps Them All")
+	fs.IntVar(&opts.MaxAge, "logMaxAge", 0, "Days a Rotated Log File is Kept, 0 Keeps Them Regardless of Age")
+
+	return opts
+}
+
+// Setup Zero Log for Console or JSON Output, to stderr or a rotated log file
+func setupLogger(verbose bool, opts *LogOptions) {
+	var out io.Writer = os.Stderr
+	logToStderr = opts.File == ""
+	if !logToStderr {
+		out = &lumberjack.Logger{
+			Filename:   opts.File,
+			MaxSize:    opts.MaxSize,
+			MaxBackups: opts.MaxBackups,
+			MaxAge:     opts.MaxAge,
+		}
+	}
+
+	logFormat = opts.Format
+	logger = newLogger(out, logFormat, !logToStderr)
+	zerolog.TimeFieldFormat = "2006-01-02 15:04:05.000"
+	zerolog.DurationFieldUnit = time.Millisecond
+	zerolog.DurationFieldInteger = true
+	if opts.Format == "json" {
+		zerolog.TimeFieldFormat = time.RFC3339Nano
+	}
+	if verbose {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
+
+// Return a New Logger writing in the format to the output
+func newLogger(out io.Writer, format string, noColor bool) zerolog.Logger {
+	if format == "console" {
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339, NoColor: noColor}
+	}
+
+	return zerolog.New(out).With().Timestamp().Logger()
+}
@@ -0,0 +1,116 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLogFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(bytes.Buffer))
+	opts := logFlags(fs)
+
+	if err := fs.Parse([]string{"-logFormat", "json", "-logFile", "run.log", "-logMaxSize", "5"}); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if opts.Format != "json" || opts.File != "run.log" || opts.MaxSize != 5 || opts.MaxBackups != 10 {
+		t.Errorf("options = %+v", *opts)
+	}
+
+	if err := fs.Parse([]string{"-logFormat", "xml"}); err == nil {
+		t.Error("expected an error for an unknown log format")
+	}
+}
+
+func TestSetupLoggerFile(t *testing.T) {
+	t.Cleanup(func() {
+		logger = zerolog.Nop()
+		logToStderr, logFormat = true, "console"
+		zerolog.TimeFieldFormat = "2006-01-02 15:04:05.000"
+	})
+
+	path := filepath.Join(t.TempDir(), "get-tmdb.log")
+	setupLogger(false, &LogOptions{Format: "json", File: path, MaxSize: 1})
+	logger.Info().Str("entity", "Movie").Msg("Test Event")
+
+	if logToStderr {
+		t.Error("expected the log to be written to a file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the log file: %v", err)
+	}
+	var event map[string]any
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", data, err)
+	}
+	if event["entity"] != "Movie" || event["message"] != "Test Event" || event["level"] != "info" {
+		t.Errorf("event = %v", event)
+	}
+}
+
+func TestRequestLogFields(t *testing.T) {
+	var out bytes.Buffer
+	logger = zerolog.New(&out)
+	t.Cleanup(func() { logger = zerolog.Nop() })
+
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 3)
+	f.status = func(path string, attempt int) int {
+		if path == "/3/movie/2" {
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	}
+	tmdb := newTestMovieDB(t, f)
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	var found bool
+	for line := range strings.SplitSeq(strings.TrimSpace(out.String()), "\n") {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if event["message"] != "API Request" || event["level"] != "error" {
+			continue
+		}
+		found = true
+		for _, key := range []string{"entity", "id", "status", "attempt", "duration_ms"} {
+			if _, ok := event[key]; !ok {
+				t.Errorf("event %v is missing %s", event, key)
+			}
+		}
+		if event["entity"] != "Movie" || event["id"] != 2.0 || event["status"] != 404.0 || event["attempt"] != 1.0 {
+			t.Errorf("event = %v", event)
+		}
+	}
+	if !found {
+		t.Errorf("no failed request was logged in %s", out.String())
+	}
+}
@@ -15,13 +15,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var logger zerolog.Logger
@@ -29,6 +36,13 @@ var applicationText = "%s 0.1.0%s"
 var copyrightText = "Copyright 2024, Matthew Winter\n"
 var indent = "..."
 
+// Exit codes used when the run is interrupted by SIGINT or SIGTERM, when the
+// run timeout is reached, or when the Daily ID Exports are not yet available
+// and the run can be retried later
+const exitInterrupted = 130
+const exitTimedOut = 124
+const exitNotAvailable = 75
+
 var helpText = `
 A command line application designed to crawl The Movie DB API following
 the The Movie DB API rules, and outputs the results as JSONL files so
@@ -39,11 +53,31 @@ Use --help for more details.
 
 USAGE:
     get-tmdb -a API_KEY -o OUTPUT_PATH
+    get-tmdb COMMAND [ARGS]
+
+COMMANDS:
+    popularity    Build a popularity history from the Daily Export IDs
+    diff-ids      List the IDs added and removed between two export dates
+    diff          List the records changed between two export dates
+    merge         Merge an export date into the snapshot store history
+    fetch         Fetch the data for an explicit list of IDs
+    shards        Check the shards of an export date cover its IDs
+    coordinate    Lease IDs to remote workers for a distributed crawl
+    work          Fetch the IDs leased by a coordinator
+    daemon        Run the crawl every day once the exports are published
+    prune         Remove the partitions outside the retention policy
 
 ARGS:
 `
 
 func main() {
+	// Run a Command in place of the crawl if one is named
+	if len(os.Args) > 1 {
+		if _, ok := commands[os.Args[1]]; ok {
+			runCommand(os.Args[1], os.Args[2:])
+		}
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, applicationText, filepath.Base(os.Args[0]), "\n")
 		fmt.Fprint(os.Stderr, copyrightText)
@@ -55,7 +89,11 @@ func main() {
 	var outputPath = flag.String("o", "", "Output Path  (Required)")
 	var tmdbAPIKey = flag.String("a", "", "The Movie DB API Key  (Required)")
 	var exportDate = flag.String("exportDate", "", "Export Date Override")
+	var fallback = flag.Bool("fallback", false, "Fall Back to the Previous Day if the Latest Daily Export is Late")
 	var justIDs = flag.Bool("justIDs", false, "Only Get Daily Export IDs")
+	var from = flag.String("from", "", "Backfill the Daily Export IDs From this Date, Requires -justIDs")
+	var to = flag.String("to", "", "Backfill the Daily Export IDs To this Date, Defaults to the Latest")
+	var parallel = flag.Int("parallel", 4, "Number of Dates Backfilled in Parallel")
 	var skipMovie = flag.Bool("skipMovie", false, "Skip Movie Data Exports")
 	var skipTVSeries = flag.Bool("skipTVSeries", false, "Skip TV Series Data Exports")
 	var skipPerson = flag.Bool("skipPerson", false, "Skip Person Data Exports")
@@ -63,28 +101,42 @@ func main() {
 	var skipTVNetwork = flag.Bool("skipTVNetwork", false, "Skip TV Network Data Exports")
 	var skipKeyword = flag.Bool("skipKeyword", false, "Skip Keyword Data Exports")
 	var skipCompany = flag.Bool("skipCompany", false, "Skip Company Data Exports")
+	var requestTimeout = flag.Duration("requestTimeout", defaultRequestTimeout, "Timeout for a Single API Request, Including Retries, Must be Positive")
+	var entityTimeout = flag.Duration("entityTimeout", 0, "Timeout for Each Entity Data Export")
+	var runTimeout = flag.Duration("runTimeout", 0, "Timeout for the Whole Run")
+	var concurrent = flag.Bool("concurrent", false, "Run the Entity Data Exports Concurrently")
+	var workers = flag.Int64("workers", numWorkers, "Number of Workers Shared by All Exports")
+	var rateLimit = flag.Float64("rateLimit", 0, "Maximum API Requests per Second Shared by All Exports")
+	var weights = flag.String("weights", "", "Entity Weights for Concurrent Exports, e.g. Movie=4,Keyword=1")
+	var filter = flag.String("filter", "", "Only Crawl the IDs Matching the Filter, e.g. popularity>=1,adult=false,video=false")
+	var popularityOrder = flag.Bool("popularityOrder", false, "Crawl the IDs in Descending Order of Popularity")
+	var sample = flag.String("sample", "", "Only Crawl a Deterministic Sample of the IDs, e.g. 1% or 1000")
+	var sampleSeed = flag.Uint64("sampleSeed", 1, "Seed Selecting the Sample of IDs")
+	var shard = flag.String("shard", "", "Only Crawl the IDs of this Shard, Given as INDEX/COUNT, e.g. 0/4")
+	var entityBudget = flag.Int64("entityBudget", 0, "Maximum API Requests, Including Retries, for Each Entity Data Export")
+	var runBudget = flag.Int64("runBudget", 0, "Maximum API Requests, Including Retries, for the Whole Run")
+	var entityTimeBox = flag.Duration("entityTimeBox", 0, "Stop Dispatching New IDs for Each Entity Data Export After this Time")
+	var runTimeBox = flag.Duration("runTimeBox", 0, "Stop Dispatching New IDs for the Whole Run After this Time")
+	var keep = flag.Int("keep", 0, "Number of the Latest Partitions Kept, Pruning the Rest After the Run")
+	var keepMonthly = flag.Bool("keepMonthly", false, "Also Keep the First Partition of Each Month When Pruning")
+	var metricsListen = flag.String("metricsListen", "", "Address to Serve Prometheus Metrics On, e.g. :9090")
+	var progressMode = flag.String("progress", "auto", "Progress Display, One of auto, bar, log or off")
+	var traceEndpoint = flag.String("traceEndpoint", "", "OTLP/HTTP Endpoint to Export Traces To, e.g. http://localhost:4318")
+	var printReport = flag.Bool("printReport", false, "Print the Run Report to stdout as Markdown")
+	var progressInterval = flag.Duration("progressInterval", 30*time.Second, "Time Between Progress Log Lines When Not Drawing Progress Bars")
+	var logOptions = logFlags(flag.CommandLine)
 	var verbose = flag.Bool("v", false, "Output Verbose Detail")
 
 	// Parse the flags
 	flag.Parse()
 
 	// Validate the Required Flags
-	if *outputPath == "" || *tmdbAPIKey == "" {
+	if *outputPath == "" || *tmdbAPIKey == "" || *requestTimeout <= 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Setup Zero Log for Consolo Output
-	output := zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
-	logger = zerolog.New(output).With().Timestamp().Logger()
-	zerolog.TimeFieldFormat = "2006-01-02 15:04:05.000"
-	zerolog.DurationFieldUnit = time.Millisecond
-	zerolog.DurationFieldInteger = true
-	if *verbose {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	}
+	setupLogger(*verbose, logOptions)
 
 	// Output Header
 	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
@@ -92,7 +144,11 @@ func main() {
 	logger.Info().Str("Output Path", *outputPath).Msg(indent)
 	logger.Info().Str("The Movie DB API Key", *tmdbAPIKey).Msg(indent)
 	logger.Info().Str("Export Date Override", *exportDate).Msg(indent)
+	logger.Info().Bool("Fall Back to the Previous Day", *fallback).Msg(indent)
 	logger.Info().Bool("Only Get Daily Export IDs", *justIDs).Msg(indent)
+	logger.Info().Str("Backfill From", *from).Msg(indent)
+	logger.Info().Str("Backfill To", *to).Msg(indent)
+	logger.Info().Int("Backfill Parallel", *parallel).Msg(indent)
 	logger.Info().Bool("Skip Movie Exports", *skipMovie).Msg(indent)
 	logger.Info().Bool("Skip TV Series Exports", *skipTVSeries).Msg(indent)
 	logger.Info().Bool("Skip Person Exports", *skipPerson).Msg(indent)
@@ -100,70 +156,311 @@ func main() {
 	logger.Info().Bool("Skip TV Network Exports", *skipTVNetwork).Msg(indent)
 	logger.Info().Bool("Skip Keyword Exports", *skipKeyword).Msg(indent)
 	logger.Info().Bool("Skip Company Exports", *skipCompany).Msg(indent)
+	logger.Info().Dur("Request Timeout", *requestTimeout).Msg(indent)
+	logger.Info().Dur("Entity Timeout", *entityTimeout).Msg(indent)
+	logger.Info().Dur("Run Timeout", *runTimeout).Msg(indent)
+	logger.Info().Bool("Concurrent Exports", *concurrent).Msg(indent)
+	logger.Info().Int64("Workers", *workers).Msg(indent)
+	logger.Info().Float64("Rate Limit", *rateLimit).Msg(indent)
+	logger.Info().Str("Entity Weights", *weights).Msg(indent)
+	logger.Info().Str("ID Filter", *filter).Msg(indent)
+	logger.Info().Str("Sample", *sample).Msg(indent)
+	logger.Info().Uint64("Sample Seed", *sampleSeed).Msg(indent)
+	logger.Info().Bool("Popularity Order", *popularityOrder).Msg(indent)
+	logger.Info().Str("Shard", *shard).Msg(indent)
+	logger.Info().Int64("Entity Request Budget", *entityBudget).Msg(indent)
+	logger.Info().Int64("Run Request Budget", *runBudget).Msg(indent)
+	logger.Info().Dur("Entity Time Box", *entityTimeBox).Msg(indent)
+	logger.Info().Dur("Run Time Box", *runTimeBox).Msg(indent)
+	logger.Info().Int("Keep Partitions", *keep).Msg(indent)
+	logger.Info().Bool("Keep Monthly Partitions", *keepMonthly).Msg(indent)
+	logger.Info().Str("Metrics Listen", *metricsListen).Msg(indent)
+	logger.Info().Str("Progress", *progressMode).Msg(indent)
+	logger.Info().Str("Trace Endpoint", *traceEndpoint).Msg(indent)
+	logger.Info().Dur("Progress Interval", *progressInterval).Msg(indent)
+	logger.Info().Bool("Print Report", *printReport).Msg(indent)
+	logger.Info().Str("Log Format", logOptions.Format).Msg(indent)
+	logger.Info().Str("Log File", logOptions.File).Msg(indent)
 	logger.Info().Msg("Begin")
 
-	tmdb := NewMovieDB(*tmdbAPIKey, *exportDate)
-	if err := tmdb.ValidateOutputPath(*outputPath); err != nil {
-		logger.Error().Err(err).Msg("Output Path Validation Failed")
-		os.Exit(1)
+	// Cancel the context on SIGINT or SIGTERM so the in-flight requests can
+	// drain, after which the default behaviour is restored so a second signal
+	// terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, func() {
+		stop()
+		logger.Warn().Msg("Shutdown Requested, Draining In-Flight Requests")
+	})
+
+	// Serve the Metrics for the length of the run, if requested
+	if *metricsListen != "" {
+		if _, err := ServeMetrics(*metricsListen); err != nil {
+			logger.Error().Err(err).Msg("Metrics Server Failed")
+			os.Exit(1)
+		}
 	}
 
-	if err := tmdb.GetDailyExports(); err != nil {
-		logger.Error().Err(err).Msg("Get Daily ID Exports Failed")
+	// Trace the run, if requested
+	if *traceEndpoint != "" {
+		if err := SetupTracing(*traceEndpoint); err != nil {
+			logger.Error().Err(err).Msg("Tracing Setup Failed")
+			os.Exit(1)
+		}
+	}
+	ctx, _ = tracer.Start(ctx, "run")
+
+	// Bound the whole run by the Run Timeout, if one has been set
+	if *runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runTimeout)
+		defer cancel()
+	}
+
+	tmdb, err := NewMovieDB(*tmdbAPIKey, *exportDate)
+	if err != nil {
+		logger.Error().Err(err).Msg("Export Date Validation Failed")
 		os.Exit(1)
 	}
+	tmdb.RequestTimeout = *requestTimeout
+	tmdb.EntityTimeout = *entityTimeout
+	tmdb.Workers = max(*workers, 1)
+	tmdb.RateLimit = *rateLimit
+	tmdb.PopularityOrder = *popularityOrder
+	tmdb.EntityBudget = *entityBudget
+	tmdb.RunBudget = *runBudget
+	tmdb.EntityTimeBox = *entityTimeBox
+	if *runTimeBox > 0 {
+		tmdb.RunDeadline = time.Now().Add(*runTimeBox)
+	}
+	if err := tmdb.ParseWeights(*weights); err != nil {
+		handleError(ctx, tmdb, err, "Entity Weights Validation Failed")
+	}
+	if tmdb.Filter, err = ParseFilter(*filter); err != nil {
+		handleError(ctx, tmdb, err, "ID Filter Validation Failed")
+	}
+	if tmdb.Sample, err = ParseSample(*sample, *sampleSeed); err != nil {
+		handleError(ctx, tmdb, err, "Sample Validation Failed")
+	}
+	if tmdb.Shard, err = ParseShard(*shard); err != nil {
+		handleError(ctx, tmdb, err, "Shard Validation Failed")
+	}
+	progress, err := NewProgressDisplay(*progressMode, *progressInterval, tmdb.ExportStatus)
+	if err != nil {
+		handleError(ctx, tmdb, err, "Progress Display Validation Failed")
+	}
 
-	// If we are only getting the IDs, then we can finish up here
-	if !*justIDs {
-		if !*skipMovie {
-			if err := tmdb.ExportMovieData(); err != nil {
-				logger.Error().Err(err).Msg("Export Movie Data Failed")
-				os.Exit(1)
-			}
+	// Backfill the Daily Export IDs over a date range, then finish up here
+	if *from != "" || *to != "" {
+		if err := backfill(ctx, tmdb, *outputPath, *from, *to, *exportDate, *justIDs, *parallel); err != nil {
+			handleError(ctx, tmdb, err, "Backfill Daily ID Exports Failed")
 		}
+		prunePartitions(ctx, tmdb, *outputPath, *keep, *keepMonthly)
+		endTracing(ctx, nil)
+		logger.Info().Msg("Done!")
+		return
+	}
 
-		if !*skipTVSeries {
-			if err := tmdb.ExportTVSeriesData(); err != nil {
-				logger.Error().Err(err).Msg("Export TV Series Data Failed")
-				os.Exit(1)
-			}
+	// Only fall back to the previous day when the export date was calculated
+	if err := tmdb.CheckDailyExports(ctx, *fallback && *exportDate == ""); err != nil {
+		if ctx.Err() == nil {
+			logger.Error().Err(err).Msg("Daily ID Exports Not Available")
+			endTracing(ctx, err)
+			os.Exit(exitNotAvailable)
 		}
+		handleError(ctx, tmdb, err, "Daily ID Exports Not Available")
+	}
+	logger.Info().Str("Export Date", tmdb.ExportDate.Format("2006-01-02")).Msg(indent)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("export_date", tmdb.ExportDate.Format("2006-01-02")))
+
+	if err := tmdb.ValidateOutputPath(*outputPath); err != nil {
+		handleError(ctx, tmdb, err, "Output Path Validation Failed")
+	}
 
-		if !*skipPerson {
-			if err := tmdb.ExportPersonData(); err != nil {
-				logger.Error().Err(err).Msg("Export Person Data Failed")
-				os.Exit(1)
+	if err := tmdb.GetDailyExports(ctx); err != nil {
+		handleError(ctx, tmdb, err, "Get Daily ID Exports Failed")
+	}
+
+	// If we are only getting the IDs, then we can finish up here
+	if !*justIDs {
+		// Draw the progress bars below the log, or log the progress
+		if progress != nil {
+			if progress.bar && logToStderr {
+				logger = newLogger(progress, logFormat, false)
 			}
+			progress.Start()
 		}
 
-		if !*skipCollection {
-			if err := tmdb.ExportCollectionData(); err != nil {
-				logger.Error().Err(err).Msg("Export Collection Data Failed")
-				os.Exit(1)
-			}
+		exports := []entityExport{
+			{*skipMovie, tmdb.ExportMovieData, "Export Movie Data Failed"},
+			{*skipTVSeries, tmdb.ExportTVSeriesData, "Export TV Series Data Failed"},
+			{*skipPerson, tmdb.ExportPersonData, "Export Person Data Failed"},
+			{*skipCollection, tmdb.ExportCollectionData, "Export Collection Data Failed"},
+			{*skipTVNetwork, tmdb.ExportTVNetworkData, "Export TV Network Data Failed"},
+			{*skipKeyword, tmdb.ExportKeywordData, "Export Keyword Data Failed"},
+			{*skipCompany, tmdb.ExportCompanyData, "Export Company Data Failed"},
 		}
 
-		if !*skipTVNetwork {
-			if err := tmdb.ExportTVNetworkData(); err != nil {
-				logger.Error().Err(err).Msg("Export TV Network Data Failed")
-				os.Exit(1)
+		if *concurrent {
+			runConcurrently(ctx, tmdb, exports)
+		} else {
+			for _, e := range exports {
+				if e.skip {
+					continue
+				}
+				if err := e.export(ctx); err != nil {
+					handleError(ctx, tmdb, err, e.failed)
+				}
 			}
 		}
+		progress.Stop()
+	}
 
-		if !*skipKeyword {
-			if err := tmdb.ExportKeywordData(); err != nil {
-				logger.Error().Err(err).Msg("Export Keyword Data Failed")
-				os.Exit(1)
-			}
+	tmdb.Close()
+	writeProgress(tmdb)
+
+	// Report on the entity exports of the run
+	if report := writeReport(tmdb); report != nil && *printReport {
+		fmt.Print(report.Markdown())
+	}
+
+	// Prune the old partitions, once this one is complete
+	prunePartitions(ctx, tmdb, *outputPath, *keep, *keepMonthly)
+
+	endTracing(ctx, nil)
+	logger.Info().Msg("Done!")
+}
+
+//---------------------------------------------------------------------------------------
+
+// Validate the Backfill Flags and Backfill the Daily Export IDs
+func backfill(ctx context.Context, tmdb *TheMovieDB, outputPath string, from string, to string, exportDate string, justIDs bool, parallel int) error {
+	switch {
+	case !justIDs:
+		return errors.New("a backfill date range requires -justIDs")
+	case exportDate != "":
+		return errors.New("a backfill date range cannot be combined with -exportDate")
+	case from == "":
+		return errors.New("a backfill date range requires -from")
+	}
+
+	fromDate, err := ParseExportDate(from, time.Now())
+	if err != nil {
+		return err
+	}
+	toDate, err := ParseExportDate(to, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tmdb.Backfill(ctx, outputPath, fromDate, toDate, parallel)
+}
+
+// Prune the Partitions outside the retention policy, if one has been set,
+// never pruning the partition written by the run
+func prunePartitions(ctx context.Context, tmdb *TheMovieDB, outputPath string, keep int, keepMonthly bool) {
+	if keep < 1 {
+		return
+	}
+	if _, err := PrunePartitions(outputPath, RetentionPolicy{keep, keepMonthly}, false, tmdb.OutputPath); err != nil {
+		handleError(ctx, tmdb, err, "Prune Partitions Failed")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+type entityExport struct {
+	skip   bool
+	export func(context.Context) error
+	failed string
+}
+
+// Run the Entity Data Exports Concurrently, sharing the one worker pool.  A
+// failure in one export stops the others, and the errors are only handled
+// once every export has written its in-flight results.
+func runConcurrently(ctx context.Context, tmdb *TheMovieDB, exports []entityExport) {
+	exportCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(exports))
+	for i, e := range exports {
+		if e.skip {
+			continue
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = e.export(exportCtx)
+			if errs[i] != nil && !errors.Is(errs[i], context.Canceled) && !errors.Is(errs[i], context.DeadlineExceeded) {
+				cancel(errs[i])
+			}
+		}()
+	}
+	wg.Wait()
 
-		if !*skipCompany {
-			if err := tmdb.ExportCompanyData(); err != nil {
-				logger.Error().Err(err).Msg("Export Company Data Failed")
-				os.Exit(1)
+	// Handle the error that caused the others to stop first
+	if cause := context.Cause(exportCtx); cause != nil && !errors.Is(cause, context.Canceled) && !errors.Is(cause, context.DeadlineExceeded) {
+		for i, err := range errs {
+			if err == cause {
+				handleError(ctx, tmdb, err, exports[i].failed)
 			}
 		}
 	}
+	for i, err := range errs {
+		if err != nil {
+			handleError(ctx, tmdb, err, exports[i].failed)
+		}
+	}
+}
 
-	logger.Info().Msg("Done!")
+//---------------------------------------------------------------------------------------
+
+// Log the Error and Exit, recording the progress made if the run was
+// interrupted or timed out.  An Entity Timeout is not fatal, the run carries
+// on with the next entity.
+func handleError(ctx context.Context, tmdb *TheMovieDB, err error, msg string) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		logger.Warn().Err(err).Msg("Export Interrupted")
+		writeProgress(tmdb)
+		writeReport(tmdb)
+		endTracing(ctx, err)
+		os.Exit(exitInterrupted)
+
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil:
+		logger.Warn().Err(err).Msg("Run Timed Out")
+		writeProgress(tmdb)
+		writeReport(tmdb)
+		endTracing(ctx, err)
+		os.Exit(exitTimedOut)
+
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Warn().Err(err).Msg("Export Timed Out")
+		return
+	}
+
+	logger.Error().Err(err).Msg(msg)
+	endTracing(ctx, err)
+	os.Exit(1)
+}
+
+// Write the Export Progress, logging any failure
+func writeProgress(tmdb *TheMovieDB) {
+	if err := tmdb.WriteProgress(); err != nil {
+		logger.Error().Err(err).Msg("Write Export Progress Failed")
+	}
+}
+
+// Write the Run Report, logging any failure, and return it.  Nil is returned
+// when no entity has been exported, as when only getting the IDs.
+func writeReport(tmdb *TheMovieDB) *RunReport {
+	report := tmdb.NewRunReport()
+	if len(report.Entities) == 0 {
+		return nil
+	}
+	if err := tmdb.WriteReport(report); err != nil {
+		logger.Error().Err(err).Msg("Write Run Report Failed")
+	}
+
+	return report
 }
@@ -0,0 +1,368 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus Metrics for the crawl, always collected and served when a
+// metrics address has been given
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tmdb_api_requests_total",
+		Help: "API request attempts by entity and status code, including retries.",
+	}, []string{"entity", "code"})
+	apiRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tmdb_api_retries_total",
+		Help: "API request attempts retrying an earlier attempt.",
+	}, []string{"entity"})
+	apiRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tmdb_api_rate_limited_total",
+		Help: "API request attempts rejected with 429 Too Many Requests.",
+	}, []string{"entity"})
+	apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tmdb_api_request_duration_seconds",
+		Help:    "Latency of each API request attempt.",
+		Buckets: []float64{.025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"entity"})
+	workersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tmdb_workers_busy",
+		Help: "Workers with a request in-flight.",
+	})
+	recordsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tmdb_records_written_total",
+		Help: "Records written to the entity data files.",
+	}, []string{"entity"})
+	recordsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tmdb_records_failed_total",
+		Help: "IDs whose API request failed after every retry.",
+	}, []string{"entity"})
+	bytesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tmdb_bytes_written_total",
+		Help: "Bytes written to the entity data files.",
+	}, []string{"entity"})
+	exportIDs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tmdb_export_ids",
+		Help: "IDs expected to be crawled, the Daily Export ID count until every ID has been dispatched.",
+	}, []string{"entity"})
+	exportIDsDone = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tmdb_export_ids_done",
+		Help: "IDs crawled so far, whether written, failed or skipped.",
+	}, []string{"entity"})
+	exportLastProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tmdb_export_last_progress_timestamp_seconds",
+		Help: "Time the last ID was crawled, for alerting on a stalled crawl.",
+	}, []string{"entity"})
+	exportEstimatedCompletion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tmdb_export_estimated_completion_timestamp_seconds",
+		Help: "Estimated time the export completes at the average rate so far.",
+	}, []string{"entity"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		apiRequests, apiRetries, apiRateLimited, apiDuration, workersBusy,
+		recordsWritten, recordsFailed, bytesWritten,
+		exportIDs, exportIDsDone, exportLastProgress, exportEstimatedCompletion,
+	)
+}
+
+//---------------------------------------------------------------------------------------
+
+// Serve the Metrics on the address at /metrics, in the background, returning
+// the server so it can be closed.  The address is bound before returning, so
+// a bad address or one already in use is an error rather than a crawl
+// running without its metrics.
+func ServeMetrics(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("Metrics Server Failed")
+		}
+	}()
+	logger.Info().Str("Metrics Listening On", ln.Addr().String()).Msg(indent)
+
+	return server, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+// The entity and attempt count of an API request, carried on its context so
+// every attempt made by the retry client can be labelled
+type requestInfo struct {
+	entity   string
+	export   *exportMetrics
+	budget   *requestBudget
+	attempts atomic.Int64
+	status   atomic.Int64
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, entity string) context.Context {
+	export, _ := ctx.Value(exportMetricsKey{}).(*exportMetrics)
+	budget, _ := ctx.Value(requestBudgetKey{}).(*requestBudget)
+	return context.WithValue(ctx, requestInfoKey{}, &requestInfo{entity: entity, export: export, budget: budget})
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// Record the Metrics of every HTTP request attempt
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := requestInfoFrom(req.Context())
+	if attempt := info.attempts.Add(1); attempt > 1 {
+		apiRetries.WithLabelValues(info.entity).Inc()
+		info.export.retried()
+		trace.SpanFromContext(req.Context()).AddEvent("retry", trace.WithAttributes(
+			attribute.Int64("attempt", attempt),
+			attribute.Int64("previous_status", info.status.Load()),
+		))
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	apiDuration.WithLabelValues(info.entity).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if resp != nil {
+		info.status.Store(int64(resp.StatusCode))
+		code = strconv.Itoa(resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			apiRateLimited.WithLabelValues(info.entity).Inc()
+			info.export.rateLimited()
+		}
+	}
+	apiRequests.WithLabelValues(info.entity, code).Inc()
+
+	return resp, err
+}
+
+// Return the status code of a failed request, or zero when no response was
+// received
+func responseStatus(err error) int {
+	var respErr *requests.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode
+	}
+	return 0
+}
+
+//---------------------------------------------------------------------------------------
+
+// Metrics of a single entity export, estimating its completion from the
+// average rate since it started.  Every export of the run is kept by The
+// Movie DB so the progress display can show them all, and the run report
+// can summarise them.
+type exportMetrics struct {
+	entity  string
+	ids     int64
+	started time.Time
+
+	mu        sync.Mutex
+	expected  int64
+	done      int64
+	failed    int64
+	failures  map[int]int64
+	retries   int64
+	throttled int64
+	finished  time.Time
+}
+
+type exportMetricsKey struct{}
+
+// Snapshot of the progress of an entity export
+type exportStatus struct {
+	Entity   string
+	Expected int64
+	Done     int64
+	Failed   int64
+	Elapsed  time.Duration
+	Finished bool
+}
+
+func newExportMetrics(entity string, expected int64) *exportMetrics {
+	exportIDs.WithLabelValues(entity).Set(float64(expected))
+	exportIDsDone.WithLabelValues(entity).Set(0)
+	exportLastProgress.WithLabelValues(entity).SetToCurrentTime()
+
+	return &exportMetrics{entity: entity, ids: expected, started: time.Now(), expected: expected, failures: map[int]int64{}}
+}
+
+// Keep the Metrics of an export of the run
+func (tmdb *TheMovieDB) addExportMetrics(m *exportMetrics) {
+	tmdb.exportsMu.Lock()
+	defer tmdb.exportsMu.Unlock()
+	tmdb.exports = append(tmdb.exports, m)
+}
+
+// Set the number of IDs expected, once every ID has been dispatched
+func (m *exportMetrics) setExpected(expected int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expected = expected
+	exportIDs.WithLabelValues(m.entity).Set(float64(expected))
+}
+
+// Record a single Result of the export
+func (m *exportMetrics) record(result *RequestResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case result == nil || errors.Is(result.Err, errBudgetExhausted):
+	case result.Err != nil:
+		m.failed++
+		m.failures[responseStatus(result.Err)]++
+		recordsFailed.WithLabelValues(m.entity).Inc()
+	default:
+		recordsWritten.WithLabelValues(m.entity).Inc()
+		bytesWritten.WithLabelValues(m.entity).Add(float64(len(result.Response) + 1))
+	}
+
+	m.done++
+	now := time.Now()
+	exportIDsDone.WithLabelValues(m.entity).Set(float64(m.done))
+	exportLastProgress.WithLabelValues(m.entity).Set(float64(now.UnixNano()) / 1e9)
+	remaining := estimateRemaining(now.Sub(m.started), m.done, m.expected)
+	exportEstimatedCompletion.WithLabelValues(m.entity).Set(float64(now.Add(remaining).UnixNano()) / 1e9)
+}
+
+// Return the context carrying the export metrics, so each API request made
+// for the export can count its retries against it
+func (m *exportMetrics) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exportMetricsKey{}, m)
+}
+
+// Count a retried API request attempt of the export
+func (m *exportMetrics) retried() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries++
+}
+
+// Count an API request attempt of the export rejected by the rate limit
+func (m *exportMetrics) rateLimited() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.throttled++
+}
+
+// Mark the export as finished, however it ended
+func (m *exportMetrics) finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished = time.Now()
+}
+
+// Return the estimated time remaining at the average rate so far
+func estimateRemaining(elapsed time.Duration, done int64, expected int64) time.Duration {
+	if done == 0 || done >= expected {
+		return 0
+	}
+	return elapsed / time.Duration(done) * time.Duration(expected-done)
+}
+
+func (m *exportMetrics) status() exportStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.finished.IsZero() {
+		return exportStatus{m.entity, m.expected, m.done, m.failed, m.finished.Sub(m.started), true}
+	}
+	return exportStatus{m.entity, m.expected, m.done, m.failed, time.Since(m.started), false}
+}
+
+// Return the status of every export of the run, in the order they started
+func (tmdb *TheMovieDB) ExportStatus() []exportStatus {
+	tmdb.exportsMu.Lock()
+	defer tmdb.exportsMu.Unlock()
+
+	var statuses []exportStatus
+	for _, m := range tmdb.exports {
+		statuses = append(statuses, m.status())
+	}
+
+	return statuses
+}
+
+//---------------------------------------------------------------------------------------
+
+// Count the lines of the Daily Export ID file, the number of IDs before any
+// filter, sample or shard is applied
+func countLines(path string) (int64, error) {
+	rf, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open the daily export IDs file: %w", err)
+	}
+	defer func() { _ = rf.Close() }()
+
+	var lines int64
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := rf.Read(buf)
+		lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, fmt.Errorf("failed reading the daily export IDs file: %w", err)
+		}
+	}
+}
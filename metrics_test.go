@@ -0,0 +1,105 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExportMetrics(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 10)
+	f.status = func(path string, attempt int) int {
+		switch {
+		case path == "/3/movie/3" && attempt <= 2:
+			return http.StatusTooManyRequests
+		case path == "/3/movie/5":
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	}
+	tmdb := newTestMovieDB(t, f)
+
+	// The metrics are global, so only compare the change over this export
+	counter := func() map[string]float64 {
+		return map[string]float64{
+			"200":     testutil.ToFloat64(apiRequests.WithLabelValues("Movie", "200")),
+			"429":     testutil.ToFloat64(apiRequests.WithLabelValues("Movie", "429")),
+			"retries": testutil.ToFloat64(apiRetries.WithLabelValues("Movie")),
+			"limited": testutil.ToFloat64(apiRateLimited.WithLabelValues("Movie")),
+			"written": testutil.ToFloat64(recordsWritten.WithLabelValues("Movie")),
+			"failed":  testutil.ToFloat64(recordsFailed.WithLabelValues("Movie")),
+		}
+	}
+	before := counter()
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	after := counter()
+	want := map[string]float64{"200": 9, "429": 2, "retries": 2, "limited": 2, "written": 9, "failed": 1}
+	for name, delta := range want {
+		if got := after[name] - before[name]; got != delta {
+			t.Errorf("%s increased by %v, want %v", name, got, delta)
+		}
+	}
+	if got := testutil.ToFloat64(exportIDsDone.WithLabelValues("Movie")); got != 10 {
+		t.Errorf("IDs done = %v, want 10", got)
+	}
+	if got := testutil.ToFloat64(exportIDs.WithLabelValues("Movie")); got != 10 {
+		t.Errorf("IDs expected = %v, want 10", got)
+	}
+	if got := testutil.ToFloat64(workersBusy); got != 0 {
+		t.Errorf("busy workers = %v, want 0", got)
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, name := range []string{"tmdb_api_request_duration_seconds_bucket", "tmdb_bytes_written_total", "tmdb_export_estimated_completion_timestamp_seconds"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("metrics missing %s", name)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	server, err := ServeMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ServeMetrics() error = %v", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	// An address already in use is an error rather than a crawl without metrics
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	if _, err := ServeMetrics(ln.Addr().String()); err == nil {
+		t.Error("expected an error for an address already in use")
+	}
+	if _, err := ServeMetrics("not an address"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
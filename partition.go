@@ -0,0 +1,92 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An export_date= Partition under the Output Path
+type Partition struct {
+	Date time.Time
+	Path string
+}
+
+//---------------------------------------------------------------------------------------
+
+// List the export_date= Partitions under the Output Path, oldest first
+func ListPartitions(outputPath string) ([]Partition, error) {
+
+	entries, err := os.ReadDir(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the output path: %w", err)
+	}
+
+	var partitions []Partition
+	for _, entry := range entries {
+		value, ok := strings.CutPrefix(entry.Name(), "export_date=")
+		if !ok || !entry.IsDir() {
+			continue
+		}
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(outputPath, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute partition path: %w", err)
+		}
+		partitions = append(partitions, Partition{date, path})
+	}
+
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Date.Before(partitions[j].Date) })
+
+	return partitions, nil
+}
+
+// Return the Partition for the given date, which must already exist
+func FindPartition(outputPath string, date time.Time) (Partition, error) {
+	path, err := filepath.Abs(filepath.Join(outputPath, fmt.Sprintf("export_date=%s", date.Format("2006-01-02"))))
+	if err != nil {
+		return Partition{}, fmt.Errorf("failed to get absolute partition path: %w", err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return Partition{}, fmt.Errorf("partition export_date=%s not found", date.Format("2006-01-02"))
+	}
+
+	return Partition{date, path}, nil
+}
+
+// Return the Partitions within the date range, inclusive, a zero date leaves
+// that end of the range open
+func FilterPartitions(partitions []Partition, from time.Time, to time.Time) []Partition {
+	var filtered []Partition
+	for _, partition := range partitions {
+		if !from.IsZero() && partition.Date.Before(from) {
+			continue
+		}
+		if !to.IsZero() && partition.Date.After(to) {
+			continue
+		}
+		filtered = append(filtered, partition)
+	}
+
+	return filtered
+}
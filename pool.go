@@ -0,0 +1,332 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/ybbus/httpretry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// Long-lived Pool of Workers sharing a single HTTP Client, used by every
+// entity export for the lifetime of the run.  Jobs are queued per entity and
+// handed to the workers by weighted round robin, so when several entities are
+// exported concurrently the large ones do not starve the small ones.
+type WorkerPool struct {
+	jobs chan *RequestJob
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	lanes   map[string]*poolLane
+	weights map[string]int64
+	closed  bool
+}
+
+type poolLane struct {
+	weight  int64
+	current int64
+	queue   []*RequestJob
+}
+
+type RequestJob struct {
+	Ctx     context.Context
+	Entity  string
+	Id      int64
+	Path    string
+	Results chan<- *RequestResult
+
+	queued bool
+}
+
+type RequestResult struct {
+	Id       int64
+	Response string
+	Err      error
+
+	chunk *traceChunk
+}
+
+//---------------------------------------------------------------------------------------
+
+// Return a New HTTP Retry Client, sharing a single Transport so connections
+// are reused across all of the workers.  A rate limit greater than zero caps
+// the requests per second, including retries, across every worker.
+func NewRequestClient(workers int64, rateLimit float64) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = int(workers)
+	transport.MaxIdleConnsPerHost = int(workers)
+
+	var rt http.RoundTripper = &metricsTransport{transport}
+	if rateLimit > 0 {
+		rt = &rateLimitedTransport{rate.NewLimiter(rate.Limit(rateLimit), 1), rt}
+	}
+	rt = &budgetTransport{rt}
+
+	return httpretry.NewCustomClient(
+		&http.Client{Transport: rt},
+		httpretry.WithMaxRetryCount(20),
+		httpretry.WithRetryPolicy(func(statusCode int, err error) bool {
+			if errors.Is(err, errBudgetExhausted) {
+				return false
+			}
+			return statusCode == 429 || err != nil || statusCode >= 500 || statusCode == 0
+		}),
+		httpretry.WithBackoffPolicy(func(attemptNum int) time.Duration {
+			return 100 * time.Millisecond
+		}),
+	)
+}
+
+// Wait for the Rate Limiter before every HTTP request attempt
+type rateLimitedTransport struct {
+	limiter *rate.Limiter
+	next    http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Take every retry from the request budget of the export, refusing the retry
+// once the budget is exhausted, the first attempt was taken when dispatched
+type budgetTransport struct {
+	next http.RoundTripper
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := requestInfoFrom(req.Context())
+	if info.attempts.Load() > 0 {
+		if exhausted := info.budget.take(); exhausted != "" {
+			return nil, fmt.Errorf("%s: %w", exhausted, errBudgetExhausted)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+//---------------------------------------------------------------------------------------
+
+// Start a New Worker Pool making requests against the given API, entities
+// without a weight are given a weight of one
+func NewWorkerPool(workers int64, rateLimit float64, weights map[string]int64, url string, apiKey string, timeout time.Duration) *WorkerPool {
+	pool := &WorkerPool{
+		jobs:    make(chan *RequestJob),
+		lanes:   map[string]*poolLane{},
+		weights: weights,
+	}
+	pool.cond = sync.NewCond(&pool.mu)
+	cl := NewRequestClient(workers, rateLimit)
+
+	for num := int64(0); num < workers; num++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			RequestWorker(cl, url, apiKey, timeout, pool.jobs)
+		}()
+	}
+
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+		pool.schedule()
+	}()
+
+	return pool
+}
+
+// Submit a Job to the Worker Pool, blocking until the job has been scheduled
+// or the context is done
+func (pool *WorkerPool) Submit(ctx context.Context, job *RequestJob) error {
+	stop := context.AfterFunc(ctx, func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		pool.cond.Broadcast()
+	})
+	defer stop()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	lane, ok := pool.lanes[job.Entity]
+	if !ok {
+		lane = &poolLane{weight: max(pool.weights[job.Entity], 1)}
+		pool.lanes[job.Entity] = lane
+	}
+	lane.queue = append(lane.queue, job)
+	job.queued = true
+	pool.cond.Broadcast()
+
+	for job.queued {
+		if err := ctx.Err(); err != nil {
+			lane.queue = slices.DeleteFunc(lane.queue, func(j *RequestJob) bool { return j == job })
+			job.queued = false
+			return err
+		}
+		pool.cond.Wait()
+	}
+
+	return nil
+}
+
+// Hand the queued jobs to the workers until the pool is closed
+func (pool *WorkerPool) schedule() {
+	for {
+		job := pool.next()
+		if job == nil {
+			close(pool.jobs)
+			return
+		}
+		pool.jobs <- job
+	}
+}
+
+// Wait for the next job to schedule, returning nil once the pool is closed
+func (pool *WorkerPool) next() *RequestJob {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for {
+		if job := pool.pick(); job != nil {
+			job.queued = false
+			pool.cond.Broadcast()
+			return job
+		}
+		if pool.closed {
+			return nil
+		}
+		pool.cond.Wait()
+	}
+}
+
+// Pick the next job using smooth weighted round robin across the entities
+// with queued jobs
+func (pool *WorkerPool) pick() *RequestJob {
+	var best *poolLane
+	var total int64
+	for _, lane := range pool.lanes {
+		if len(lane.queue) == 0 {
+			continue
+		}
+		lane.current += lane.weight
+		total += lane.weight
+		if best == nil || lane.current > best.current {
+			best = lane
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	best.current -= total
+	job := best.queue[0]
+	best.queue = best.queue[1:]
+
+	return job
+}
+
+// Stop the Worker Pool and wait for the workers to exit
+func (pool *WorkerPool) Close() {
+	pool.mu.Lock()
+	pool.closed = true
+	pool.cond.Broadcast()
+	pool.mu.Unlock()
+
+	pool.wg.Wait()
+}
+
+//---------------------------------------------------------------------------------------
+
+// Worker for Concurrent HTTP API Requests, sending each result back on the
+// results channel of the job
+func RequestWorker(cl *http.Client, url string, apiKey string, timeout time.Duration, jobs <-chan *RequestJob) {
+	for job := range jobs {
+		// Once a shutdown has been requested skip any jobs not yet started
+		if job.Ctx.Err() != nil {
+			traceChunkFrom(job.Ctx).done(0)
+			job.Results <- nil
+			continue
+		}
+
+		workersBusy.Inc()
+		result := RequestData(withRequestInfo(job.Ctx, job.Entity), cl, url, fmt.Sprintf(job.Path, job.Id), apiKey, timeout, job.Id)
+		result.chunk = traceChunkFrom(job.Ctx)
+		workersBusy.Dec()
+		job.Results <- result
+	}
+}
+
+// Make the API Request, letting it complete even if a shutdown is requested
+// while it is in-flight, but never for longer than the given timeout, nor
+// past the deadline of the run or entity
+func RequestData(ctx context.Context, cl *http.Client, url string, path string, apiKey string, timeout time.Duration, id int64) *RequestResult {
+	deadline, hasDeadline := ctx.Deadline()
+	ctx = context.WithoutCancel(ctx)
+	if hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	info := requestInfoFrom(ctx)
+	ctx, span := tracer.Start(ctx, "GET", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("entity", info.entity),
+		attribute.Int64("id", id),
+		attribute.String("url.path", path),
+	))
+
+	start := time.Now()
+	result := &RequestResult{Id: id}
+	result.Err = requests.
+		URL(url).
+		Path(path).
+		Param("api_key", apiKey).
+		Client(cl).
+		ToString(&result.Response).
+		Fetch(ctx)
+
+	span.SetAttributes(
+		attribute.Int64("http.response.status_code", info.status.Load()),
+		attribute.Int64("attempts", info.attempts.Load()),
+	)
+	endSpan(span, result.Err)
+
+	event := logger.Debug()
+	if result.Err != nil {
+		event = logger.Error().Err(result.Err)
+	}
+	event.Str("entity", info.entity).Int64("id", id).Int64("status", info.status.Load()).
+		Int64("attempt", info.attempts.Load()).Int64("duration_ms", time.Since(start).Milliseconds()).
+		Msg("API Request")
+
+	return result
+}
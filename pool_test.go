@@ -0,0 +1,144 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolReusesConnections(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 2000)
+	f.setIDs("person_ids", 2000)
+	tmdb := newTestMovieDB(t, f)
+	before := f.conns.Load()
+
+	// The same pool, and so the same connections, serve every entity export
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+	pool := tmdb.workerPool()
+	if err := tmdb.ExportPersonData(t.Context()); err != nil {
+		t.Fatalf("ExportPersonData() error = %v", err)
+	}
+	if tmdb.workerPool() != pool {
+		t.Error("expected the worker pool to be reused across exports")
+	}
+
+	// Allow some slack for connections raced open while another was returned
+	if got := f.conns.Load() - before; got > 2*numWorkers {
+		t.Errorf("opened %d connections for 4000 requests, want at most %d", got, 2*numWorkers)
+	}
+	if ids := readIDs(t, tmdb.DailyExports["Person"].DataFile); len(ids) != 2000 {
+		t.Errorf("exported %d person records, want 2000", len(ids))
+	}
+}
+
+func TestWorkerPoolWeights(t *testing.T) {
+	f := newFakeTMDB(t)
+
+	// A single worker makes the scheduling order visible in the results
+	pool := NewWorkerPool(1, 0, map[string]int64{"Movie": 3}, f.URL, "test-key", time.Minute)
+	defer pool.Close()
+
+	results := make(chan *RequestResult, 200)
+	var wg sync.WaitGroup
+	for _, entity := range []string{"Movie", "Keyword"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := int64(1); id <= 100; id++ {
+				job := &RequestJob{Ctx: t.Context(), Entity: entity, Id: id, Path: "/3/" + strings.ToLower(entity) + "/%d", Results: results}
+				if err := pool.Submit(t.Context(), job); err != nil {
+					t.Errorf("Submit() error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	// While both entities have work queued, movies get three of every four requests
+	movies := 0
+	for range 80 {
+		if strings.Contains((<-results).Response, `"movie"`) {
+			movies++
+		}
+	}
+	if movies < 50 || movies > 70 {
+		t.Errorf("movies = %d of the first 80 requests, want about 60", movies)
+	}
+
+	for range 120 {
+		<-results
+	}
+	wg.Wait()
+}
+
+func TestWorkerPoolSubmitCancelled(t *testing.T) {
+	f := newFakeTMDB(t)
+	pool := NewWorkerPool(1, 0, nil, f.URL, "test-key", time.Minute)
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	job := &RequestJob{Ctx: ctx, Entity: "Movie", Id: 1, Path: "/3/movie/%d", Results: make(chan *RequestResult, 1)}
+	if err := pool.Submit(ctx, job); !errors.Is(err, context.Canceled) {
+		t.Errorf("Submit() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("keyword_ids", 10)
+	tmdb := newTestMovieDB(t, f)
+	tmdb.RateLimit = 20
+
+	start := time.Now()
+	if err := tmdb.ExportKeywordData(t.Context()); err != nil {
+		t.Fatalf("ExportKeywordData() error = %v", err)
+	}
+
+	// Ten requests at twenty per second, with a burst of one
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("10 requests took %v, expected the rate limit to slow them down", elapsed)
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	tmdb := testMovieDB(t)
+
+	if err := tmdb.ParseWeights("movie=4, tv_series=2,Keyword=1,"); err != nil {
+		t.Fatalf("ParseWeights() error = %v", err)
+	}
+	want := map[string]int64{"Movie": 4, "TV Series": 2, "Keyword": 1}
+	if !maps.Equal(tmdb.Weights, want) {
+		t.Errorf("Weights = %v, want %v", tmdb.Weights, want)
+	}
+
+	for _, weights := range []string{"Movie", "Movie=0", "Movie=x", "Film=1"} {
+		if err := tmdb.ParseWeights(weights); err == nil {
+			t.Errorf("ParseWeights(%q) expected an error", weights)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Entities whose Daily Export IDs carry a popularity value
+var PopularityEntities = []string{"Movie", "TV Series", "Person"}
+
+// A single row of the long-format Popularity History
+type PopularityRecord struct {
+	Entity     string  `json:"entity"`
+	Id         int64   `json:"id"`
+	Date       string  `json:"date"`
+	Popularity float64 `json:"popularity"`
+	Adult      bool    `json:"adult"`
+	Video      bool    `json:"video"`
+}
+
+//---------------------------------------------------------------------------------------
+
+// Write the Popularity History, one JSONL record per entity ID per export
+// date, from the Daily Export ID files found in the given partitions
+func WritePopularityHistory(w io.Writer, partitions []Partition, entities []string) (int64, error) {
+
+	logger.Info().Msg("Initiating Build of the Popularity History")
+
+	dailyExports := NewDailyExports()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var rowCount int64 = 0
+	for _, partition := range partitions {
+		date := partition.Date.Format("2006-01-02")
+		logger.Info().Str("export_date", date).Msg(indent)
+
+		for _, entity := range entities {
+			path := filepath.Join(partition.Path, dailyExports[entity].Name)
+			count, err := writePopularity(enc, path, entity, date)
+			if os.IsNotExist(err) {
+				logger.Debug().Str("path", path).Msg("Daily Export IDs Missing, Skipping")
+				continue
+			}
+			if err != nil {
+				return rowCount, err
+			}
+			rowCount += count
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return rowCount, fmt.Errorf("failed writing the popularity history: %w", err)
+	}
+
+	logger.Info().Int64("records", rowCount).Msg("Popularity History Written")
+
+	return rowCount, nil
+}
+
+// Write the Popularity of every ID in a single Daily Export ID file
+func writePopularity(enc *json.Encoder, path string, entity string, date string) (int64, error) {
+
+	rf, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rf.Close() }()
+
+	r := bufio.NewScanner(rf)
+	r.Split(bufio.ScanLines)
+
+	var rowCount int64 = 0
+	for r.Scan() {
+		record := new(PopularityRecord)
+		if err := json.Unmarshal(r.Bytes(), record); err != nil {
+			return rowCount, fmt.Errorf("failed to unmarshal the daily export JSON data in %s: %w", path, err)
+		}
+		record.Entity = entity
+		record.Date = date
+
+		if err := enc.Encode(record); err != nil {
+			return rowCount, fmt.Errorf("failed writing the popularity history: %w", err)
+		}
+		rowCount++
+	}
+	if err := r.Err(); err != nil {
+		return rowCount, fmt.Errorf("failed reading %s: %w", path, err)
+	}
+
+	return rowCount, nil
+}
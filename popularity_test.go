@@ -0,0 +1,157 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write the given files into the export_date= partition under dir
+func writePartition(t *testing.T, dir string, date string, files map[string]string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "export_date="+date)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+func TestListPartitions(t *testing.T) {
+	dir := t.TempDir()
+	writePartition(t, dir, "2024-05-02", nil)
+	writePartition(t, dir, "2024-04-30", nil)
+	writePartition(t, dir, "2024-05-01", nil)
+	writePartition(t, dir, "not-a-date", nil)
+	if err := os.WriteFile(filepath.Join(dir, "export_date=2024-05-03"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	partitions, err := ListPartitions(dir)
+	if err != nil {
+		t.Fatalf("ListPartitions() error = %v", err)
+	}
+
+	var dates []string
+	for _, partition := range partitions {
+		dates = append(dates, partition.Date.Format("2006-01-02"))
+	}
+	if got := strings.Join(dates, ","); got != "2024-04-30,2024-05-01,2024-05-02" {
+		t.Errorf("ListPartitions() dates = %s", got)
+	}
+
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if got := FilterPartitions(partitions, from, time.Time{}); len(got) != 2 {
+		t.Errorf("FilterPartitions() from %s returned %d partitions, want 2", from, len(got))
+	}
+	if got := FilterPartitions(partitions, time.Time{}, from); len(got) != 2 {
+		t.Errorf("FilterPartitions() to %s returned %d partitions, want 2", from, len(got))
+	}
+}
+
+func TestWritePopularityHistory(t *testing.T) {
+	dir := t.TempDir()
+	writePartition(t, dir, "2024-05-01", map[string]string{
+		"movie_ids.json":     `{"adult":false,"id":1,"original_title":"A","popularity":10.5,"video":true}` + "\n",
+		"person_ids.json":    `{"adult":true,"id":7,"name":"P","popularity":1.25}` + "\n",
+		"tv_series_ids.json": `{"id":3,"original_name":"T","popularity":2}` + "\n",
+		"keyword_ids.json":   `{"id":9,"name":"K"}` + "\n",
+	})
+	writePartition(t, dir, "2024-05-02", map[string]string{
+		"movie_ids.json": `{"adult":false,"id":1,"original_title":"A","popularity":12,"video":true}` + "\n" +
+			`{"adult":false,"id":2,"original_title":"B","popularity":0.6,"video":false}` + "\n",
+	})
+
+	partitions, err := ListPartitions(dir)
+	if err != nil {
+		t.Fatalf("ListPartitions() error = %v", err)
+	}
+
+	var b bytes.Buffer
+	count, err := WritePopularityHistory(&b, partitions, PopularityEntities)
+	if err != nil {
+		t.Fatalf("WritePopularityHistory() error = %v", err)
+	}
+	if count != 5 {
+		t.Errorf("WritePopularityHistory() count = %d, want 5", count)
+	}
+
+	var records []PopularityRecord
+	dec := json.NewDecoder(&b)
+	for dec.More() {
+		var record PopularityRecord
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("invalid popularity record: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	want := []PopularityRecord{
+		{"Movie", 1, "2024-05-01", 10.5, false, true},
+		{"TV Series", 3, "2024-05-01", 2, false, false},
+		{"Person", 7, "2024-05-01", 1.25, true, false},
+		{"Movie", 1, "2024-05-02", 12, false, true},
+		{"Movie", 2, "2024-05-02", 0.6, false, false},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("record %d = %+v, want %+v", i, records[i], want[i])
+		}
+	}
+}
+
+func TestWritePopularityHistoryMalformedLine(t *testing.T) {
+	dir := t.TempDir()
+	writePartition(t, dir, "2024-05-01", map[string]string{"movie_ids.json": "{\"id\":1,\n"})
+
+	partitions, err := ListPartitions(dir)
+	if err != nil {
+		t.Fatalf("ListPartitions() error = %v", err)
+	}
+
+	var b bytes.Buffer
+	if _, err := WritePopularityHistory(&b, partitions, []string{"Movie"}); err == nil {
+		t.Error("WritePopularityHistory() expected an error for a malformed line")
+	}
+}
+
+func TestParseEntities(t *testing.T) {
+	got, err := ParseEntities("person, movie,tv-series,movie", PopularityEntities)
+	if err != nil {
+		t.Fatalf("ParseEntities() error = %v", err)
+	}
+	if strings.Join(got, ",") != "Person,Movie,TV Series" {
+		t.Errorf("ParseEntities() = %v", got)
+	}
+
+	if _, err := ParseEntities("keyword", PopularityEntities); err == nil {
+		t.Error("ParseEntities() expected an error for an entity without popularity")
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// Progress of the entity exports, either drawn as a live display of progress
+// bars below the log, when the output is a terminal, or logged periodically
+type ProgressDisplay struct {
+	out      io.Writer
+	bar      bool
+	interval time.Duration
+	status   func() []exportStatus
+
+	mu    sync.Mutex
+	lines int
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+const progressBarWidth = 30
+const progressRedraw = 500 * time.Millisecond
+
+//---------------------------------------------------------------------------------------
+
+// Return a New Progress Display for the mode, one of auto, bar, log or off,
+// of the exports whose status is returned by the status function.  Auto
+// draws progress bars when stderr is a terminal and logs the progress
+// otherwise.  Nil is returned when the progress is off.
+func NewProgressDisplay(mode string, interval time.Duration, status func() []exportStatus) (*ProgressDisplay, error) {
+	progress := &ProgressDisplay{out: os.Stderr, interval: interval, status: status}
+
+	switch mode {
+	case "auto":
+		progress.bar = isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd())
+	case "bar":
+		progress.bar = true
+	case "log":
+	case "off":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid progress mode %q, expected auto, bar, log or off", mode)
+	}
+
+	if progress.bar {
+		progress.interval = progressRedraw
+	}
+	if progress.interval <= 0 {
+		return nil, fmt.Errorf("invalid progress interval %s", interval)
+	}
+
+	return progress, nil
+}
+
+// Start updating the Progress Display in the background
+func (progress *ProgressDisplay) Start() {
+	progress.stop = make(chan struct{})
+	progress.done = make(chan struct{})
+
+	go func() {
+		defer close(progress.done)
+		ticker := time.NewTicker(progress.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				progress.update(false)
+			case <-progress.stop:
+				progress.update(true)
+				return
+			}
+		}
+	}()
+}
+
+// Stop the Progress Display, leaving the final progress shown, or logging it
+func (progress *ProgressDisplay) Stop() {
+	if progress == nil || progress.stop == nil {
+		return
+	}
+	close(progress.stop)
+	<-progress.done
+	progress.stop = nil
+}
+
+// Write the log output above the progress bars, redrawing them below it
+func (progress *ProgressDisplay) Write(p []byte) (int, error) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	if !progress.bar {
+		return progress.out.Write(p)
+	}
+
+	var b bytes.Buffer
+	progress.clear(&b)
+	b.Write(p)
+	progress.draw(&b)
+	if _, err := progress.out.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (progress *ProgressDisplay) update(final bool) {
+	if !progress.bar {
+		progress.log(final)
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	var b bytes.Buffer
+	progress.clear(&b)
+	progress.draw(&b)
+	_, _ = progress.out.Write(b.Bytes())
+}
+
+// Erase the progress bars last drawn, moving the cursor back up over them
+func (progress *ProgressDisplay) clear(b *bytes.Buffer) {
+	if progress.lines > 0 {
+		fmt.Fprintf(b, "\033[%dA\033[J", progress.lines)
+	}
+	progress.lines = 0
+}
+
+// Draw a progress bar for each export of the run
+func (progress *ProgressDisplay) draw(b *bytes.Buffer) {
+	for _, s := range progress.status() {
+		b.WriteString(formatProgressBar(s))
+		b.WriteByte('\n')
+		progress.lines++
+	}
+}
+
+// Log the progress of the exports still running, and on the final update
+// those which have finished too
+func (progress *ProgressDisplay) log(final bool) {
+	for _, s := range progress.status() {
+		if s.Finished && !final {
+			continue
+		}
+		logger.Info().
+			Str("entity", s.Entity).
+			Int64("done", s.Done).
+			Int64("total", s.Expected).
+			Float64("percent", math.Round(s.percent()*10)/10).
+			Float64("req_per_sec", math.Round(s.rate()*10)/10).
+			Float64("error_rate", math.Round(s.errorRate()*100)/100).
+			Int64("eta_ms", s.remaining().Milliseconds()).
+			Msg("Progress")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+// Format a single progress bar, e.g.
+// Movie       [#########---------------------]  30.0%  3000/10000  48.2 req/s  0.10% errors  ETA 2m25s
+func formatProgressBar(s exportStatus) string {
+	filled := int(s.percent() / 100 * progressBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+
+	eta := "ETA " + s.remaining().Round(time.Second).String()
+	if s.Finished {
+		eta = "Done in " + s.Elapsed.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("%-11s [%s] %5.1f%%  %d/%d  %.1f req/s  %.2f%% errors  %s",
+		s.Entity, bar, s.percent(), s.Done, s.Expected, s.rate(), s.errorRate(), eta)
+}
+
+func (s exportStatus) percent() float64 {
+	if s.Expected <= 0 || s.Done >= s.Expected {
+		return 100
+	}
+	return float64(s.Done) / float64(s.Expected) * 100
+}
+
+func (s exportStatus) rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Done) / s.Elapsed.Seconds()
+}
+
+func (s exportStatus) errorRate() float64 {
+	if s.Done == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Done) * 100
+}
+
+func (s exportStatus) remaining() time.Duration {
+	return estimateRemaining(s.Elapsed, s.Done, s.Expected)
+}
@@ -0,0 +1,84 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatProgressBar(t *testing.T) {
+	s := exportStatus{Entity: "Movie", Expected: 1000, Done: 250, Failed: 5, Elapsed: 10 * time.Second}
+
+	want := "Movie       [#######-----------------------]  25.0%  250/1000  25.0 req/s  2.00% errors  ETA 30s"
+	if got := formatProgressBar(s); got != want {
+		t.Errorf("formatProgressBar() =\n%q\nwant\n%q", got, want)
+	}
+
+	s.Done, s.Finished = 1000, true
+	if got := formatProgressBar(s); !strings.Contains(got, "100.0%") || !strings.HasSuffix(got, "Done in 10s") {
+		t.Errorf("formatProgressBar(finished) = %q", got)
+	}
+}
+
+func TestProgressDisplayBar(t *testing.T) {
+	var out bytes.Buffer
+	progress := &ProgressDisplay{out: &out, bar: true, interval: time.Hour, status: func() []exportStatus {
+		return []exportStatus{{Entity: "Movie", Expected: 10, Done: 5}, {Entity: "Keyword", Expected: 4, Done: 1}}
+	}}
+
+	// Log lines are written above the bars, which are erased and redrawn below
+	if _, err := progress.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := progress.Write([]byte("second\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 7 || lines[0] != "first" || !strings.HasPrefix(lines[1], "Movie") || !strings.HasPrefix(lines[3], "\033[2A\033[Jsecond") {
+		t.Errorf("output = %q", out.String())
+	}
+
+	progress.Start()
+	progress.Stop()
+	progress.Stop()
+	if !strings.HasSuffix(out.String(), "\033[2A\033[J"+formatProgressBar(progress.status()[0])+"\n"+formatProgressBar(progress.status()[1])+"\n") {
+		t.Errorf("final output = %q", out.String())
+	}
+}
+
+func TestNewProgressDisplay(t *testing.T) {
+	if progress, err := NewProgressDisplay("off", time.Second, nil); progress != nil || err != nil {
+		t.Errorf("NewProgressDisplay(off) = %v, %v", progress, err)
+	}
+	if progress, err := NewProgressDisplay("log", time.Second, nil); err != nil || progress.bar || progress.interval != time.Second {
+		t.Errorf("NewProgressDisplay(log) = %+v, %v", progress, err)
+	}
+	if progress, err := NewProgressDisplay("bar", time.Second, nil); err != nil || !progress.bar || progress.interval != progressRedraw {
+		t.Errorf("NewProgressDisplay(bar) = %+v, %v", progress, err)
+	}
+	if _, err := NewProgressDisplay("fancy", time.Second, nil); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	if _, err := NewProgressDisplay("log", 0, nil); err == nil {
+		t.Error("expected an error for a zero interval")
+	}
+
+	var none *ProgressDisplay
+	none.Stop()
+}
@@ -0,0 +1,229 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report of a run, summarising each entity export so a run can be checked
+// without reading the log
+type RunReport struct {
+	ExportDate string         `json:"export_date"`
+	Shard      string         `json:"shard,omitempty"`
+	Started    time.Time      `json:"started"`
+	Finished   time.Time      `json:"finished"`
+	DurationMS int64          `json:"duration_ms"`
+	Entities   []EntityReport `json:"entities"`
+}
+
+// Report of a single entity export, the failures keyed by the status code of
+// the last attempt, or "error" when no response was received
+type EntityReport struct {
+	Entity           string           `json:"entity"`
+	Status           string           `json:"status"`
+	DailyIDs         int64            `json:"daily_ids"`
+	Filtered         int64            `json:"filtered"`
+	RecordsExported  int64            `json:"records_exported"`
+	Failed           int64            `json:"failed"`
+	FailuresByStatus map[string]int64 `json:"failures_by_status"`
+	Skipped          int64            `json:"skipped"`
+	Retries          int64            `json:"retries"`
+	RateLimited      int64            `json:"rate_limited"`
+	DurationMS       int64            `json:"duration_ms"`
+	RequestsPerSec   float64          `json:"req_per_sec"`
+	DataFile         string           `json:"data_file"`
+	DataFileBytes    int64            `json:"data_file_bytes"`
+}
+
+//---------------------------------------------------------------------------------------
+
+// Return the Report of the run so far, covering every entity exported, in
+// the order they are exported
+func (tmdb *TheMovieDB) NewRunReport() *RunReport {
+	finished := time.Now()
+	report := &RunReport{
+		ExportDate: tmdb.ExportDate.Format("2006-01-02"),
+		Started:    tmdb.Started,
+		Finished:   finished,
+		DurationMS: finished.Sub(tmdb.Started).Milliseconds(),
+	}
+	if tmdb.Shard != nil {
+		report.Shard = fmt.Sprintf("%d/%d", tmdb.Shard.Index, tmdb.Shard.Count)
+	}
+
+	tmdb.exportsMu.Lock()
+	defer tmdb.exportsMu.Unlock()
+
+	for _, entity := range Entities {
+		for _, m := range tmdb.exports {
+			if m.entity == entity {
+				report.Entities = append(report.Entities, m.report(tmdb.DailyExports[entity]))
+			}
+		}
+	}
+
+	return report
+}
+
+// Return the Report of the export, adding the progress and size of the data
+// file written
+func (m *exportMetrics) report(dailyExport *DailyExport) EntityReport {
+	s := m.status()
+
+	m.mu.Lock()
+	report := EntityReport{
+		Entity:           m.entity,
+		Status:           "completed",
+		DailyIDs:         m.ids,
+		Failed:           m.failed,
+		FailuresByStatus: map[string]int64{},
+		Retries:          m.retries,
+		RateLimited:      m.throttled,
+		DurationMS:       s.Elapsed.Milliseconds(),
+		RequestsPerSec:   math.Round(s.rate()*10) / 10,
+	}
+	for code, count := range m.failures {
+		report.FailuresByStatus[statusText(code)] = count
+	}
+	m.mu.Unlock()
+
+	if dailyExport == nil {
+		return report
+	}
+	if progress := dailyExport.Progress; progress != nil {
+		report.Filtered = progress.Filtered
+		report.RecordsExported = progress.RecordsExported
+		report.Skipped = progress.Skipped
+		switch {
+		case progress.Interrupted:
+			report.Status = "interrupted"
+		case progress.TimedOut:
+			report.Status = "timed out"
+		case progress.BudgetExhausted != "":
+			report.Status = progress.BudgetExhausted + " exhausted"
+		}
+	}
+	report.DataFile = filepath.Base(dailyExport.DataFile)
+	if info, err := os.Stat(dailyExport.DataFile); err == nil {
+		report.DataFileBytes = info.Size()
+	}
+
+	return report
+}
+
+// Return the status code as text, or "error" when no response was received
+func statusText(code int) string {
+	if code == 0 {
+		return "error"
+	}
+	return strconv.Itoa(code)
+}
+
+//---------------------------------------------------------------------------------------
+
+// Write the Run Report to the Output Path as report.json and report.md, with
+// the file names suffixed by the shard if any
+func (tmdb *TheMovieDB) WriteReport(report *RunReport) error {
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal the run report: %w", err)
+	}
+
+	name := filepath.Join(tmdb.OutputPath, fmt.Sprintf("report%s", tmdb.Shard.Suffix()))
+	if err := os.WriteFile(name+".json", data, 0600); err != nil {
+		return fmt.Errorf("failed to write the run report file: %w", err)
+	}
+	if err := os.WriteFile(name+".md", []byte(report.Markdown()), 0600); err != nil {
+		return fmt.Errorf("failed to write the run report file: %w", err)
+	}
+
+	return nil
+}
+
+// Return the Run Report formatted as Markdown
+func (report *RunReport) Markdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Run Report for %s", report.ExportDate)
+	if report.Shard != "" {
+		fmt.Fprintf(&b, ", Shard %s", report.Shard)
+	}
+	fmt.Fprintf(&b, "\n\nStarted %s, finished %s, taking %s.\n\n",
+		report.Started.Format(time.DateTime), report.Finished.Format(time.DateTime), formatDurationMS(report.DurationMS))
+
+	if len(report.Entities) == 0 {
+		b.WriteString("No entities were exported.\n")
+		return b.String()
+	}
+
+	b.WriteString("| Entity | Status | Daily IDs | Exported | Failed | Retries | 429s | Duration | Req/s | Data File | Size |\n")
+	b.WriteString("| --- | --- | ---: | ---: | ---: | ---: | ---: | ---: | ---: | --- | ---: |\n")
+	for _, e := range report.Entities {
+		fmt.Fprintf(&b, "| %s | %s | %d | %d | %d | %d | %d | %s | %.1f | %s | %s |\n",
+			e.Entity, e.Status, e.DailyIDs, e.RecordsExported, e.Failed, e.Retries, e.RateLimited,
+			formatDurationMS(e.DurationMS), e.RequestsPerSec, e.DataFile, formatBytes(e.DataFileBytes))
+	}
+
+	// List the failures of each entity by status code, if there are any
+	var failures strings.Builder
+	for _, e := range report.Entities {
+		for _, code := range slices.Sorted(maps.Keys(e.FailuresByStatus)) {
+			fmt.Fprintf(&failures, "| %s | %s | %d |\n", e.Entity, code, e.FailuresByStatus[code])
+		}
+	}
+	if failures.Len() > 0 {
+		b.WriteString("\n## Failures by Status\n\n")
+		b.WriteString("| Entity | Status | Failures |\n")
+		b.WriteString("| --- | --- | ---: |\n")
+		b.WriteString(failures.String())
+	}
+
+	return b.String()
+}
+
+// Format a duration in milliseconds to the second, or to the millisecond
+// when under a second
+func formatDurationMS(ms int64) string {
+	d := time.Duration(ms) * time.Millisecond
+	if d < time.Second {
+		return d.String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// Format a size in bytes using binary units, e.g. 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,133 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunReport(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 10)
+	f.status = func(path string, attempt int) int {
+		switch {
+		case path == "/3/movie/3" && attempt == 1:
+			return http.StatusTooManyRequests
+		case path == "/3/movie/7":
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	}
+	tmdb := newTestMovieDB(t, f)
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+	if err := tmdb.ExportKeywordData(t.Context()); err != nil {
+		t.Fatalf("ExportKeywordData() error = %v", err)
+	}
+
+	if err := tmdb.WriteReport(tmdb.NewRunReport()); err != nil {
+		t.Fatalf("WriteReport() error = %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmdb.OutputPath, "report.json"))
+	if err != nil {
+		t.Fatalf("failed to read the report: %v", err)
+	}
+	var report RunReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("report %s is not JSON: %v", data, err)
+	}
+
+	if report.ExportDate != "2024-05-01" || len(report.Entities) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	movie, keyword := report.Entities[0], report.Entities[1]
+	if movie.Entity != "Movie" || keyword.Entity != "Keyword" {
+		t.Errorf("entities = %s, %s, want Movie, Keyword", movie.Entity, keyword.Entity)
+	}
+	if movie.Status != "completed" || movie.DailyIDs != 10 || movie.RecordsExported != 9 || movie.Failed != 1 {
+		t.Errorf("movie = %+v", movie)
+	}
+	if movie.FailuresByStatus["404"] != 1 || len(movie.FailuresByStatus) != 1 {
+		t.Errorf("failures by status = %v, want 404: 1", movie.FailuresByStatus)
+	}
+	if movie.Retries != 1 || movie.RateLimited != 1 {
+		t.Errorf("retries = %d, rate limited = %d, want 1 and 1", movie.Retries, movie.RateLimited)
+	}
+	info, err := os.Stat(filepath.Join(tmdb.OutputPath, "movie.json"))
+	if err != nil {
+		t.Fatalf("failed to stat the data file: %v", err)
+	}
+	if movie.DataFile != "movie.json" || movie.DataFileBytes != info.Size() || movie.DataFileBytes == 0 {
+		t.Errorf("data file = %s of %d bytes, want movie.json of %d bytes", movie.DataFile, movie.DataFileBytes, info.Size())
+	}
+	if keyword.DailyIDs != 1 || keyword.Retries != 0 || keyword.Failed != 0 {
+		t.Errorf("keyword = %+v", keyword)
+	}
+
+	markdown, err := os.ReadFile(filepath.Join(tmdb.OutputPath, "report.md"))
+	if err != nil {
+		t.Fatalf("failed to read the report: %v", err)
+	}
+	for _, want := range []string{"# Run Report for 2024-05-01", "| Movie | completed | 10 | 9 | 1 | 1 | 1 |", "| Movie | 404 | 1 |"} {
+		if !strings.Contains(string(markdown), want) {
+			t.Errorf("report.md is missing %q:\n%s", want, markdown)
+		}
+	}
+}
+
+func TestRunReportInterrupted(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(10)
+	tmdb := newTestMovieDB(t, f)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := tmdb.ExportMovieData(ctx); err == nil {
+		t.Fatal("ExportMovieData() expected an error once interrupted")
+	}
+
+	report := writeReport(tmdb)
+	if report == nil || len(report.Entities) != 1 || report.Entities[0].Status != "interrupted" {
+		t.Fatalf("report = %+v", report)
+	}
+	if !fileExists(filepath.Join(tmdb.OutputPath, "report.md")) {
+		t.Error("report.md was not written for the interrupted run")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 30:         "3.0 GiB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
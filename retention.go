@@ -0,0 +1,91 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Retention Policy for the export_date= Partitions under the Output Path.
+// The latest Keep partitions are always kept, along with the first partition
+// of each month when KeepMonthly is set, and the rest are pruned.  Partitions
+// holding just the Daily Export IDs count the same as full crawls.
+type RetentionPolicy struct {
+	Keep        int
+	KeepMonthly bool
+}
+
+//---------------------------------------------------------------------------------------
+
+// Split the Partitions, oldest first, into those to keep and those to prune
+func (policy RetentionPolicy) Apply(partitions []Partition) (keep []Partition, prune []Partition) {
+	monthly := map[string]bool{}
+
+	for i, partition := range partitions {
+		month := partition.Date.Format("2006-01")
+		switch {
+		case i >= len(partitions)-policy.Keep:
+			keep = append(keep, partition)
+		case policy.KeepMonthly && !monthly[month]:
+			keep = append(keep, partition)
+		default:
+			prune = append(prune, partition)
+		}
+		monthly[month] = true
+	}
+
+	return keep, prune
+}
+
+// Prune the Partitions under the Output Path falling outside the Retention
+// Policy, returning those pruned.  The current partition, the one just
+// written by the run if any, is never pruned.  A dry run only reports them.
+func PrunePartitions(outputPath string, policy RetentionPolicy, dryRun bool, current string) ([]Partition, error) {
+	if policy.Keep < 1 {
+		return nil, fmt.Errorf("invalid retention policy, at least 1 partition must be kept")
+	}
+
+	logger.Info().Msg("Initiating Prune of Partitions")
+
+	partitions, err := ListPartitions(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, prune := policy.Apply(partitions)
+	if current != "" {
+		current, err = filepath.Abs(current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute partition path: %w", err)
+		}
+		prune = slices.DeleteFunc(prune, func(partition Partition) bool { return partition.Path == current })
+	}
+	for _, partition := range prune {
+		logger.Info().Str("Pruning", partition.Path).Bool("Dry Run", dryRun).Msg(indent)
+		if dryRun {
+			continue
+		}
+		if err := os.RemoveAll(partition.Path); err != nil {
+			return nil, fmt.Errorf("failed to remove the partition %s: %w", partition.Path, err)
+		}
+	}
+
+	logger.Info().Int("Partitions", len(partitions)).Int("Pruned", len(prune)).Msg(indent)
+
+	return prune, nil
+}
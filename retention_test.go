@@ -0,0 +1,92 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPrunePartitions(t *testing.T) {
+	dir := t.TempDir()
+	dates := []string{"2024-04-01", "2024-04-15", "2024-04-30", "2024-05-02", "2024-05-03", "2024-05-04", "2024-05-05"}
+	for _, date := range dates {
+		if err := os.Mkdir(filepath.Join(dir, "export_date="+date), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An ID only partition and other directories under the output path
+	if err := os.WriteFile(filepath.Join(dir, "export_date=2024-04-15", "movie_ids.json"), []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "store"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining := func() []string {
+		partitions, err := ListPartitions(dir)
+		if err != nil {
+			t.Fatalf("ListPartitions() error = %v", err)
+		}
+		var got []string
+		for _, partition := range partitions {
+			got = append(got, partition.Date.Format("2006-01-02"))
+		}
+		return got
+	}
+
+	pruned, err := PrunePartitions(dir, RetentionPolicy{Keep: 2, KeepMonthly: true}, true, "")
+	if err != nil {
+		t.Fatalf("PrunePartitions() error = %v", err)
+	}
+	if len(pruned) != 3 || !slices.Equal(remaining(), dates) {
+		t.Errorf("dry run pruned %d, left %v", len(pruned), remaining())
+	}
+
+	if _, err := PrunePartitions(dir, RetentionPolicy{Keep: 2, KeepMonthly: true}, false, ""); err != nil {
+		t.Fatalf("PrunePartitions() error = %v", err)
+	}
+	if got, want := remaining(), []string{"2024-04-01", "2024-05-02", "2024-05-04", "2024-05-05"}; !slices.Equal(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+
+	if _, err := PrunePartitions(dir, RetentionPolicy{Keep: 1}, false, ""); err != nil {
+		t.Fatalf("PrunePartitions() error = %v", err)
+	}
+	if got, want := remaining(), []string{"2024-05-05"}; !slices.Equal(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "store")); err != nil {
+		t.Errorf("store directory was removed: %v", err)
+	}
+
+	// The partition written by the run is kept, even when outside the policy
+	current := filepath.Join(dir, "export_date=2024-04-01")
+	if err := os.Mkdir(current, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrunePartitions(dir, RetentionPolicy{Keep: 1}, false, current); err != nil {
+		t.Fatalf("PrunePartitions() error = %v", err)
+	}
+	if got, want := remaining(), []string{"2024-04-01", "2024-05-05"}; !slices.Equal(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+
+	if _, err := PrunePartitions(dir, RetentionPolicy{}, false, ""); err == nil {
+		t.Error("expected an error keeping no partitions")
+	}
+}
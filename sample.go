@@ -0,0 +1,105 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Deterministic Sample of the Daily Export IDs, selected by a seeded hash of
+// each ID so the same seed selects the same IDs every day.  Either a fixed
+// percentage of the IDs, or the N IDs with the lowest hash, are selected.
+type Sample struct {
+	Percent float64
+	Count   int64
+	Seed    uint64
+}
+
+//---------------------------------------------------------------------------------------
+
+// Parse a sample size, either a percentage such as 1% or a number of IDs
+func ParseSample(spec string, seed uint64) (*Sample, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	if value, ok := strings.CutSuffix(spec, "%"); ok {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid sample %q, expected a percentage between 0 and 100", spec)
+		}
+		return &Sample{Percent: percent, Seed: seed}, nil
+	}
+
+	count, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid sample %q, expected a percentage such as 1%% or a number of IDs", spec)
+	}
+
+	return &Sample{Count: count, Seed: seed}, nil
+}
+
+// Return true if the ID is within a percentage sample, a nil sample or a
+// sample by count matches everything
+func (sample *Sample) Match(id int64) bool {
+	if sample == nil || sample.Percent == 0 {
+		return true
+	}
+
+	return float64(sample.hash(id)) < sample.Percent/100*math.MaxUint64
+}
+
+// Return true if the sample selects a number of IDs, which can only be done
+// once every ID has been read
+func (sample *Sample) limited() bool {
+	return sample != nil && sample.Count > 0
+}
+
+// Select the sample from the IDs, keeping their order
+func (sample *Sample) Select(ids []ExportID) []ExportID {
+	if !sample.limited() || int64(len(ids)) <= sample.Count {
+		return ids
+	}
+
+	hashes := make([]uint64, len(ids))
+	for i, id := range ids {
+		hashes[i] = sample.hash(id.Id)
+	}
+	sorted := slices.Clone(hashes)
+	slices.Sort(sorted)
+	cutoff := sorted[sample.Count-1]
+
+	var selected []ExportID
+	for i, id := range ids {
+		if hashes[i] <= cutoff && int64(len(selected)) < sample.Count {
+			selected = append(selected, id)
+		}
+	}
+
+	return selected
+}
+
+// Seeded hash of the ID using the SplitMix64 finaliser
+func (sample *Sample) hash(id int64) uint64 {
+	z := uint64(id) + sample.Seed*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,121 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSample(t *testing.T) {
+	if s, err := ParseSample("2.5%", 7); err != nil || *s != (Sample{Percent: 2.5, Seed: 7}) {
+		t.Errorf("ParseSample(2.5%%) = %v, %v", s, err)
+	}
+	if s, err := ParseSample("1000", 7); err != nil || *s != (Sample{Count: 1000, Seed: 7}) {
+		t.Errorf("ParseSample(1000) = %v, %v", s, err)
+	}
+	if s, err := ParseSample("", 7); err != nil || s != nil {
+		t.Errorf("ParseSample(\"\") = %v, %v, want nil, nil", s, err)
+	}
+
+	for _, spec := range []string{"0%", "101%", "x%", "0", "-5", "ten"} {
+		if _, err := ParseSample(spec, 1); err == nil {
+			t.Errorf("ParseSample(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestSampleMatch(t *testing.T) {
+	sample, _ := ParseSample("10%", 42)
+
+	var matched []int64
+	for id := int64(1); id <= 10000; id++ {
+		if sample.Match(id) {
+			matched = append(matched, id)
+		}
+	}
+	if len(matched) < 800 || len(matched) > 1200 {
+		t.Errorf("matched %d of 10000 IDs, want about 1000", len(matched))
+	}
+
+	// The same seed selects the same IDs, a different seed different ones
+	again, _ := ParseSample("10%", 42)
+	other, _ := ParseSample("10%", 43)
+	var differs bool
+	for _, id := range matched {
+		if !again.Match(id) {
+			t.Fatalf("ID %d not matched by the same seed", id)
+		}
+		differs = differs || !other.Match(id)
+	}
+	if !differs {
+		t.Error("expected a different seed to select different IDs")
+	}
+}
+
+func TestSampleSelect(t *testing.T) {
+	sample, _ := ParseSample("5", 1)
+
+	var ids []ExportID
+	for id := int64(1); id <= 100; id++ {
+		ids = append(ids, ExportID{Id: id})
+	}
+	selected := sample.Select(ids)
+	if len(selected) != 5 {
+		t.Fatalf("selected %d IDs, want 5", len(selected))
+	}
+	if !slices.IsSortedFunc(selected, func(a, b ExportID) int { return int(a.Id - b.Id) }) {
+		t.Errorf("selected IDs %v are not in file order", selected)
+	}
+
+	// A new ID only displaces a selected ID if it hashes lower
+	grown := sample.Select(append(slices.Clone(ids), ExportID{Id: 101}))
+	var kept int
+	for _, id := range grown {
+		if slices.Contains(selected, id) {
+			kept++
+		}
+	}
+	if kept < 4 {
+		t.Errorf("only %d of the selected IDs were kept after adding one ID", kept)
+	}
+}
+
+func TestExportDataSample(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(50)
+
+	tmdb := newTestMovieDB(t, f)
+	tmdb.Sample, _ = ParseSample("10", 3)
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+	first := readIDs(t, tmdb.DailyExports["Movie"].DataFile)
+	if len(first) != 10 {
+		t.Fatalf("exported %d movies, want 10", len(first))
+	}
+	if progress := tmdb.DailyExports["Movie"].Progress; progress.IDsRead != 50 || progress.Filtered != 40 {
+		t.Errorf("progress = %+v", *progress)
+	}
+
+	// A second export selects the same sample
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+	if second := readIDs(t, tmdb.DailyExports["Movie"].DataFile); !slices.Equal(first, second) {
+		t.Errorf("second sample = %v, want %v", second, first)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Shard of the crawl, holding the IDs where id mod Count equals Index
+type Shard struct {
+	Index int64
+	Count int64
+}
+
+// Coverage of the Daily Export IDs by the shard data files of an entity
+type ShardCoverage struct {
+	IDs           int64   `json:"ids"`
+	Covered       int64   `json:"covered"`
+	Missing       int64   `json:"missing"`
+	Misplaced     int64   `json:"misplaced"`
+	Duplicates    int64   `json:"duplicates"`
+	MissingShards []int64 `json:"missing_shards,omitempty"`
+}
+
+//---------------------------------------------------------------------------------------
+
+// Parse a shard given as INDEX/COUNT, e.g. 0/4, with the index from zero
+func ParseShard(spec string) (*Shard, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	index, count, ok := strings.Cut(spec, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid shard %q, expected INDEX/COUNT", spec)
+	}
+	shard := new(Shard)
+	var err error
+	if shard.Index, err = strconv.ParseInt(index, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid shard %q, expected INDEX/COUNT", spec)
+	}
+	if shard.Count, err = strconv.ParseInt(count, 10, 64); err != nil || shard.Count < 1 {
+		return nil, fmt.Errorf("invalid shard %q, expected a positive shard count", spec)
+	}
+	if shard.Index < 0 || shard.Index >= shard.Count {
+		return nil, fmt.Errorf("invalid shard %q, the index must be from 0 to %d", spec, shard.Count-1)
+	}
+
+	return shard, nil
+}
+
+// Return true if the ID belongs to the shard, a nil shard holds every ID
+func (shard *Shard) Match(id int64) bool {
+	return shard == nil || id%shard.Count == shard.Index
+}
+
+// Return the suffix added to the names of the files written by the shard
+func (shard *Shard) Suffix() string {
+	if shard == nil {
+		return ""
+	}
+	return fmt.Sprintf("_shard_%d_of_%d", shard.Index, shard.Count)
+}
+
+//---------------------------------------------------------------------------------------
+
+// Check the shard data files of a partition together cover its Daily Export
+// IDs.  For each entity every shard data file must exist and only hold IDs of
+// its own shard, and the IDs not found in any shard are written to
+// <entity>_missing_ids.json so they can be fetched.  With combine set the
+// shard data files are concatenated into the unsharded <entity>.json.
+func CheckShards(partition Partition, count int64, entities []string, combine bool) (map[string]*ShardCoverage, error) {
+
+	logger.Info().Msg("Initiating Check of Shard Coverage")
+
+	dailyExports := NewDailyExports()
+	coverage := map[string]*ShardCoverage{}
+
+	for _, entity := range entities {
+		idFile := filepath.Join(partition.Path, dailyExports[entity].Name)
+		if !fileExists(idFile) {
+			logger.Warn().Str("entity", entity).Msg("Daily Export IDs Missing, Skipping")
+			continue
+		}
+
+		c, err := checkEntityShards(partition, entity, idFile, count, combine)
+		if err != nil {
+			return nil, fmt.Errorf("%s shard check failed: %w", entity, err)
+		}
+		coverage[entity] = c
+
+		logger.Info().Str("entity", entity).Int64("covered", c.Covered).Int64("missing", c.Missing).
+			Int64("misplaced", c.Misplaced).Int("missing_shards", len(c.MissingShards)).Msg(indent)
+	}
+
+	data, err := json.MarshalIndent(coverage, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the shard coverage: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(partition.Path, fmt.Sprintf("shard_coverage_of_%d.json", count)), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write the shard coverage: %w", err)
+	}
+
+	for entity, c := range coverage {
+		if len(c.MissingShards) > 0 || c.Misplaced > 0 || c.Duplicates > 0 {
+			return coverage, fmt.Errorf("%s shards are incomplete or inconsistent", entity)
+		}
+	}
+
+	return coverage, nil
+}
+
+func checkEntityShards(partition Partition, entity string, idFile string, count int64, combine bool) (*ShardCoverage, error) {
+	c := new(ShardCoverage)
+	name := entityFileName(entity)
+
+	var files []string
+	seen := map[int64]bool{}
+	for index := int64(0); index < count; index++ {
+		shard := &Shard{index, count}
+		path := filepath.Join(partition.Path, fmt.Sprintf("%s%s.json", name, shard.Suffix()))
+		if !fileExists(path) {
+			c.MissingShards = append(c.MissingShards, index)
+			continue
+		}
+		files = append(files, path)
+
+		if err := scanDataFile(path, func(id int64, offset int64, line []byte) error {
+			switch {
+			case !shard.Match(id):
+				c.Misplaced++
+			case seen[id]:
+				c.Duplicates++
+			default:
+				seen[id] = true
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every ID in the Daily Export not found in a shard is missing
+	missingFile := filepath.Join(partition.Path, fmt.Sprintf("%s_missing_ids.json", name))
+	err := writeLines(missingFile, func(w *bufio.Writer) error {
+		return scanIDFile(idFile, func(id int64, line []byte) error {
+			c.IDs++
+			if seen[id] {
+				c.Covered++
+				return nil
+			}
+			c.Missing++
+			return writeLine(w, line)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.Missing == 0 {
+		_ = os.Remove(missingFile)
+	}
+
+	if combine && len(c.MissingShards) == 0 {
+		if err := combineFiles(filepath.Join(partition.Path, fmt.Sprintf("%s.json", name)), files); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Concatenate the files into a new file
+func combineFiles(path string, files []string) error {
+	return writeLines(path, func(w *bufio.Writer) error {
+		for _, file := range files {
+			rf, err := os.Open(file)
+			if err != nil {
+				return fmt.Errorf("failed to open the shard data file: %w", err)
+			}
+			_, err = w.ReadFrom(rf)
+			_ = rf.Close()
+			if err != nil {
+				return fmt.Errorf("failed writing to the output file: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseShard(t *testing.T) {
+	if s, err := ParseShard("1/4"); err != nil || *s != (Shard{1, 4}) {
+		t.Errorf("ParseShard(1/4) = %v, %v", s, err)
+	}
+	if s, err := ParseShard(""); err != nil || s != nil {
+		t.Errorf("ParseShard(\"\") = %v, %v, want nil, nil", s, err)
+	}
+
+	for _, spec := range []string{"1", "4/4", "-1/4", "0/0", "a/b"} {
+		if _, err := ParseShard(spec); err == nil {
+			t.Errorf("ParseShard(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestShardedExport(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(20)
+	f.status = func(path string, attempt int) int {
+		if path == "/3/movie/5" {
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	}
+
+	// Both shards crawl into the same export_date= partition
+	dir := t.TempDir()
+	for index := int64(0); index < 2; index++ {
+		tmdb := testMovieDB(t)
+		tmdb.APIURL = f.URL
+		tmdb.ExportsURL = f.URL
+		tmdb.Shard = &Shard{index, 2}
+		t.Cleanup(tmdb.Close)
+
+		if err := tmdb.ValidateOutputPath(dir); err != nil {
+			t.Fatalf("ValidateOutputPath() error = %v", err)
+		}
+		if err := tmdb.GetDailyExports(t.Context()); err != nil {
+			t.Fatalf("GetDailyExports() error = %v", err)
+		}
+		if err := tmdb.ExportMovieData(t.Context()); err != nil {
+			t.Fatalf("ExportMovieData() error = %v", err)
+		}
+		if err := tmdb.WriteProgress(); err != nil {
+			t.Fatalf("WriteProgress() error = %v", err)
+		}
+		if progress := tmdb.DailyExports["Movie"].Progress; progress.IDsRead != 10 {
+			t.Errorf("shard %d read %d IDs, want 10", index, progress.IDsRead)
+		}
+	}
+
+	partition := Partition{Path: filepath.Join(dir, "export_date="+testExportDate)}
+	if got := readIDs(t, filepath.Join(partition.Path, "movie_shard_1_of_2.json")); !slices.Equal(got, []int64{1, 3, 7, 9, 11, 13, 15, 17, 19}) {
+		t.Errorf("shard 1 IDs = %v", got)
+	}
+	if !fileExists(filepath.Join(partition.Path, "progress_shard_0_of_2.json")) {
+		t.Error("expected a shard suffixed progress file")
+	}
+
+	coverage, err := CheckShards(partition, 2, []string{"Movie"}, true)
+	if err != nil {
+		t.Fatalf("CheckShards() error = %v", err)
+	}
+	if got, want := *coverage["Movie"], (ShardCoverage{IDs: 20, Covered: 19, Missing: 1}); !shardCoverageEqual(got, want) {
+		t.Errorf("coverage = %+v, want %+v", got, want)
+	}
+	if got := readIDs(t, filepath.Join(partition.Path, "movie_missing_ids.json")); !slices.Equal(got, []int64{5}) {
+		t.Errorf("missing IDs = %v, want [5]", got)
+	}
+	if got := readIDs(t, filepath.Join(partition.Path, "movie.json")); len(got) != 19 {
+		t.Errorf("combined %d records, want 19", len(got))
+	}
+
+	// Checking for more shards than were crawled reports the missing shard
+	coverage, err = CheckShards(partition, 3, []string{"Movie"}, false)
+	if err == nil || !slices.Equal(coverage["Movie"].MissingShards, []int64{0, 1, 2}) {
+		t.Errorf("CheckShards(3) = %+v, %v, want missing shards", coverage["Movie"], err)
+	}
+}
+
+func shardCoverageEqual(a ShardCoverage, b ShardCoverage) bool {
+	return a.IDs == b.IDs && a.Covered == b.Covered && a.Missing == b.Missing &&
+		a.Misplaced == b.Misplaced && a.Duplicates == b.Duplicates && slices.Equal(a.MissingShards, b.MissingShards)
+}
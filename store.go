@@ -0,0 +1,285 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// A single version of a record in the Snapshot Store.  The version is valid
+// from its valid_from date up to, but not including, its valid_to date, the
+// current version has no valid_to date.
+type StoreVersion struct {
+	Id        int64           `json:"id"`
+	ValidFrom string          `json:"valid_from"`
+	ValidTo   *string         `json:"valid_to"`
+	Hash      string          `json:"hash"`
+	Record    json.RawMessage `json:"record"`
+}
+
+// Cumulative Snapshot Store holding, per entity, every version of every
+// record as JSONL along with the last export date merged into it
+type SnapshotStore struct {
+	Path   string
+	Merged map[string]string
+}
+
+//---------------------------------------------------------------------------------------
+
+// Open the Snapshot Store, creating it if it does not yet exist
+func OpenSnapshotStore(path string) (*SnapshotStore, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the snapshot store: %w", err)
+	}
+
+	store := &SnapshotStore{Path: path, Merged: map[string]string{}}
+	data, err := os.ReadFile(store.statePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the snapshot store state: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.Merged); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the snapshot store state: %w", err)
+	}
+
+	return store, nil
+}
+
+func (store *SnapshotStore) statePath() string {
+	return filepath.Join(store.Path, "state.json")
+}
+
+func (store *SnapshotStore) writeState() error {
+	data, err := json.MarshalIndent(store.Merged, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal the snapshot store state: %w", err)
+	}
+	if err := os.WriteFile(store.statePath(), data, 0600); err != nil {
+		return fmt.Errorf("failed to write the snapshot store state: %w", err)
+	}
+
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+// Merge the entity data files of a partition into the Snapshot Store.  A
+// record whose content hash is unchanged keeps its current version, a changed
+// record closes its current version and opens a new one, and an ID no longer
+// in the partition's Daily Export IDs has its current version closed.  An ID
+// still listed but without a record, such as one whose request failed, keeps
+// its current version.  Partitions must be merged in date order, and an
+// entity whose export was interrupted, timed out, ran out of budget, or was
+// filtered or sampled is skipped, as its data file is not a full snapshot.
+func (store *SnapshotStore) Merge(partition Partition, entities []string) (map[string]*DiffSummary, error) {
+
+	logger.Info().Msg("Initiating Merge into the Snapshot Store")
+
+	date := partition.Date.Format("2006-01-02")
+	progress, err := readProgress(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := map[string]*DiffSummary{}
+	for _, entity := range entities {
+		dataFile := filepath.Join(partition.Path, fmt.Sprintf("%s.json", entityFileName(entity)))
+		if !fileExists(dataFile) {
+			logger.Warn().Str("entity", entity).Msg("Entity Data Missing, Skipping")
+			continue
+		}
+		idsFile := filepath.Join(partition.Path, NewDailyExports()[entity].Name)
+		if !fileExists(idsFile) {
+			logger.Warn().Str("entity", entity).Msg("Daily Export IDs Missing, Skipping")
+			continue
+		}
+		if p := progress[entity]; p != nil && !p.complete() {
+			logger.Warn().Str("entity", entity).Msg("Entity Export Incomplete, Skipping")
+			continue
+		}
+		if merged := store.Merged[entity]; merged >= date {
+			return nil, fmt.Errorf("%s export date %s is not after the last merged date %s", entity, date, merged)
+		}
+
+		s, err := store.mergeEntity(entity, date, dataFile, idsFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s merge failed: %w", entity, err)
+		}
+		summary[entity] = s
+
+		store.Merged[entity] = date
+		if err := store.writeState(); err != nil {
+			return nil, err
+		}
+
+		logger.Info().Str("entity", entity).
+			Int64("inserted", s.Inserted).Int64("updated", s.Updated).Int64("deleted", s.Deleted).Msg(indent)
+	}
+
+	return summary, nil
+}
+
+// Fold a single entity data file into the store file for the entity, which
+// is rewritten to a temporary file and then renamed into place
+func (store *SnapshotStore) mergeEntity(entity string, date string, dataFile string, idsFile string) (*DiffSummary, error) {
+	summary := new(DiffSummary)
+	storeFile := filepath.Join(store.Path, fmt.Sprintf("%s.json", entityFileName(entity)))
+
+	// Content hash of the current version of every record
+	current := map[int64]string{}
+	if fileExists(storeFile) {
+		if err := scanStoreFile(storeFile, func(version *StoreVersion) error {
+			if version.ValidTo == nil {
+				current[version.Id] = version.Hash
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// IDs still listed in the Daily Export, whose versions are kept even
+	// when the record is missing from the data file
+	listed := map[int64]bool{}
+	if err := scanIDFile(idsFile, func(id int64, line []byte) error {
+		listed[id] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Records which are new or changed need a new version
+	changed := map[int64]bool{}
+	seen := map[int64]bool{}
+	if err := scanDataFile(dataFile, func(id int64, offset int64, line []byte) error {
+		seen[id] = true
+		hash, ok := current[id]
+		switch {
+		case !ok:
+			summary.Inserted++
+			changed[id] = true
+		case hash != hashContent(line):
+			summary.Updated++
+			changed[id] = true
+		default:
+			summary.Unchanged++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	tmpFile := storeFile + ".tmp"
+	err := writeLines(tmpFile, func(w *bufio.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+
+		// Carry over the existing versions, closing those replaced or deleted
+		if fileExists(storeFile) {
+			if err := scanStoreFile(storeFile, func(version *StoreVersion) error {
+				removed := !listed[version.Id] && !seen[version.Id]
+				if version.ValidTo == nil && (changed[version.Id] || removed) {
+					version.ValidTo = &date
+					if removed {
+						summary.Deleted++
+					}
+				}
+				return enc.Encode(version)
+			}); err != nil {
+				return err
+			}
+		}
+
+		// Then open a new version for every new or changed record
+		return scanDataFile(dataFile, func(id int64, offset int64, line []byte) error {
+			if !changed[id] {
+				return nil
+			}
+			return enc.Encode(&StoreVersion{Id: id, ValidFrom: date, Hash: hashContent(line), Record: slices.Clone(line)})
+		})
+	})
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return nil, err
+	}
+
+	if err := os.Rename(tmpFile, storeFile); err != nil {
+		return nil, fmt.Errorf("failed to replace the snapshot store file: %w", err)
+	}
+
+	return summary, nil
+}
+
+// Return the SHA-256 hash of the record, ignoring insignificant whitespace
+func hashContent(line []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, line); err != nil {
+		buf.Reset()
+		buf.Write(line)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+//---------------------------------------------------------------------------------------
+
+// Scan a Snapshot Store file calling fn with each version
+func scanStoreFile(path string, fn func(version *StoreVersion) error) error {
+	return scanDataFile(path, func(id int64, offset int64, line []byte) error {
+		version := new(StoreVersion)
+		if err := json.Unmarshal(line, version); err != nil {
+			return fmt.Errorf("failed to unmarshal the snapshot store version in %s: %w", path, err)
+		}
+		return fn(version)
+	})
+}
+
+// Return true if the export wrote a record for every ID it could, so its
+// data file is a full snapshot of the entity
+func (progress *ExportProgress) complete() bool {
+	return !progress.Interrupted && !progress.TimedOut && progress.BudgetExhausted == "" &&
+		progress.Filtered == 0 && !progress.Sampled
+}
+
+// Read the Export Progress of a partition, if it was written
+func readProgress(partition Partition) (map[string]*ExportProgress, error) {
+	progress := map[string]*ExportProgress{}
+
+	data, err := os.ReadFile(filepath.Join(partition.Path, "progress.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the export progress file: %w", err)
+	}
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the export progress file: %w", err)
+	}
+
+	return progress, nil
+}
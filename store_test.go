@@ -0,0 +1,182 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Merge the data into the store, listing the IDs of the data and any extra
+// IDs in the Daily Export
+func mergePartition(t *testing.T, store *SnapshotStore, dir string, date string, data string, extraIDs ...int64) *DiffSummary {
+	t.Helper()
+
+	var ids strings.Builder
+	for line := range strings.SplitSeq(strings.TrimSpace(data), "\n") {
+		var record struct {
+			Id int64 `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&ids, "{\"id\":%d}\n", record.Id)
+	}
+	for _, id := range extraIDs {
+		fmt.Fprintf(&ids, "{\"id\":%d}\n", id)
+	}
+
+	path := writePartition(t, dir, date, map[string]string{"movie.json": data, "movie_ids.json": ids.String()})
+	day, _ := time.Parse("2006-01-02", date)
+	summary, err := store.Merge(Partition{day, path}, []string{"Movie"})
+	if err != nil {
+		t.Fatalf("Merge(%s) error = %v", date, err)
+	}
+
+	return summary["Movie"]
+}
+
+func readVersions(t *testing.T, path string) map[int64][]StoreVersion {
+	t.Helper()
+
+	versions := map[int64][]StoreVersion{}
+	if err := scanStoreFile(path, func(version *StoreVersion) error {
+		versions[version.Id] = append(versions[version.Id], *version)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return versions
+}
+
+func validTo(version StoreVersion) string {
+	if version.ValidTo == nil {
+		return ""
+	}
+	return *version.ValidTo
+}
+
+func TestSnapshotStoreMerge(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenSnapshotStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore() error = %v", err)
+	}
+
+	s := mergePartition(t, store, dir, "2024-05-01", `{"id":1,"runtime":90}`+"\n"+`{"id":2,"runtime":100}`+"\n")
+	if got, want := *s, (DiffSummary{Inserted: 2}); got != want {
+		t.Errorf("2024-05-01 summary = %+v, want %+v", got, want)
+	}
+	s = mergePartition(t, store, dir, "2024-05-02", `{"id":1,"runtime":91}`+"\n"+`{"id":2, "runtime":100}`+"\n"+`{"id":3,"runtime":80}`+"\n")
+	if got, want := *s, (DiffSummary{Inserted: 1, Updated: 1, Unchanged: 1}); got != want {
+		t.Errorf("2024-05-02 summary = %+v, want %+v", got, want)
+	}
+	s = mergePartition(t, store, dir, "2024-05-03", `{"id":1,"runtime":91}`+"\n"+`{"id":3,"runtime":80}`+"\n")
+	if got, want := *s, (DiffSummary{Deleted: 1, Unchanged: 2}); got != want {
+		t.Errorf("2024-05-03 summary = %+v, want %+v", got, want)
+	}
+
+	versions := readVersions(t, filepath.Join(store.Path, "movie.json"))
+
+	if got := versions[1]; len(got) != 2 ||
+		got[0].ValidFrom != "2024-05-01" || validTo(got[0]) != "2024-05-02" || string(got[0].Record) != `{"id":1,"runtime":90}` ||
+		got[1].ValidFrom != "2024-05-02" || validTo(got[1]) != "" || string(got[1].Record) != `{"id":1,"runtime":91}` {
+		t.Errorf("versions of 1 = %+v", got)
+	}
+	if got := versions[2]; len(got) != 1 || got[0].ValidFrom != "2024-05-01" || validTo(got[0]) != "2024-05-03" {
+		t.Errorf("versions of 2 = %+v", got)
+	}
+	if got := versions[3]; len(got) != 1 || got[0].ValidFrom != "2024-05-02" || validTo(got[0]) != "" {
+		t.Errorf("versions of 3 = %+v", got)
+	}
+
+	// The merged date is persisted and an older date is rejected
+	reopened, err := OpenSnapshotStore(store.Path)
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore() error = %v", err)
+	}
+	if got := reopened.Merged["Movie"]; got != "2024-05-03" {
+		t.Errorf("Merged[Movie] = %q, want 2024-05-03", got)
+	}
+	day := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	if _, err := reopened.Merge(Partition{day, filepath.Join(dir, "export_date=2024-05-02")}, []string{"Movie"}); err == nil {
+		t.Error("Merge() expected an error for an already merged date")
+	}
+}
+
+func TestSnapshotStoreMergeKeepsFailedRecords(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenSnapshotStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore() error = %v", err)
+	}
+
+	mergePartition(t, store, dir, "2024-05-01", `{"id":1,"runtime":90}`+"\n"+`{"id":2,"runtime":100}`+"\n")
+
+	// ID 2 is still listed but its request failed, so its version is kept
+	s := mergePartition(t, store, dir, "2024-05-02", `{"id":1,"runtime":90}`+"\n", 2)
+	if got, want := *s, (DiffSummary{Unchanged: 1}); got != want {
+		t.Errorf("2024-05-02 summary = %+v, want %+v", got, want)
+	}
+	s = mergePartition(t, store, dir, "2024-05-03", `{"id":1,"runtime":90}`+"\n"+`{"id":2,"runtime":100}`+"\n")
+	if got, want := *s, (DiffSummary{Unchanged: 2}); got != want {
+		t.Errorf("2024-05-03 summary = %+v, want %+v", got, want)
+	}
+
+	versions := readVersions(t, filepath.Join(store.Path, "movie.json"))
+	if got := versions[2]; len(got) != 1 || got[0].ValidFrom != "2024-05-01" || validTo(got[0]) != "" {
+		t.Errorf("versions of 2 = %+v", got)
+	}
+}
+
+func TestSnapshotStoreMergeSkipsIncomplete(t *testing.T) {
+	tests := map[string]string{
+		"interrupted": `{"Movie":{"interrupted":true}}`,
+		"timed out":   `{"Movie":{"timed_out":true}}`,
+		"budget":      `{"Movie":{"budget_exhausted":"entity budget"}}`,
+		"filtered":    `{"Movie":{"filtered":3}}`,
+		"sampled":     `{"Movie":{"sampled":true}}`,
+		"no ids":      "",
+	}
+	for name, progress := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := OpenSnapshotStore(filepath.Join(dir, "store"))
+			if err != nil {
+				t.Fatalf("OpenSnapshotStore() error = %v", err)
+			}
+
+			files := map[string]string{"movie.json": `{"id":1}` + "\n", "movie_ids.json": `{"id":1}` + "\n"}
+			if progress != "" {
+				files["progress.json"] = progress
+			} else {
+				delete(files, "movie_ids.json")
+			}
+			path := writePartition(t, dir, "2024-05-01", files)
+			summary, err := store.Merge(Partition{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), path}, []string{"Movie"})
+			if err != nil {
+				t.Fatalf("Merge() error = %v", err)
+			}
+			if _, ok := summary["Movie"]; ok || fileExists(filepath.Join(store.Path, "movie.json")) {
+				t.Error("expected the incomplete Movie export to be skipped")
+			}
+		})
+	}
+}
@@ -17,25 +17,59 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/carlmjohnson/requests"
-	"github.com/ybbus/httpretry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TheMovieDB struct {
-	APIKey       string
-	OutputPath   string
-	ExportDate   time.Time
-	DailyExports map[string]*DailyExport
+	APIKey          string
+	APIURL          string
+	ExportsURL      string
+	OutputPath      string
+	ExportDate      time.Time
+	RequestTimeout  time.Duration
+	EntityTimeout   time.Duration
+	Workers         int64
+	RateLimit       float64
+	Weights         map[string]int64
+	Filter          *IDFilter
+	Sample          *Sample
+	Shard           *Shard
+	PopularityOrder bool
+	EntityBudget    int64
+	RunBudget       int64
+	EntityTimeBox   time.Duration
+	RunDeadline     time.Time
+	DailyExports    map[string]*DailyExport
+	Started         time.Time
+
+	poolOnce    sync.Once
+	pool        *WorkerPool
+	runRequests atomic.Int64
+
+	exportsMu sync.Mutex
+	exports   []*exportMetrics
+
+	// Progress file written in place of progress.json, if set
+	progressFile string
 }
 
 type DailyExport struct {
@@ -44,6 +78,19 @@ type DailyExport struct {
 	Name       string
 	ExportFile string
 	DataFile   string
+	Progress   *ExportProgress
+}
+
+type ExportProgress struct {
+	IDsRead         int64  `json:"ids_read"`
+	RecordsExported int64  `json:"records_exported"`
+	Failed          int64  `json:"failed"`
+	Skipped         int64  `json:"skipped"`
+	Filtered        int64  `json:"filtered"`
+	Sampled         bool   `json:"sampled"`
+	BudgetExhausted string `json:"budget_exhausted,omitempty"`
+	Interrupted     bool   `json:"interrupted"`
+	TimedOut        bool   `json:"timed_out"`
 }
 
 type MovieExport struct {
@@ -87,46 +134,97 @@ type CompanyExport struct {
 	Name string `json:"name,omitempty"`
 }
 
-// Worker Pool constants
+// Every entity in the order they are exported
+var Entities = []string{"Movie", "TV Series", "Person", "Collection", "TV Network", "Keyword", "Company"}
+
+// The API path of each entity, formatted with the ID
+var entityAPIPaths = map[string]string{
+	"Movie":      "/3/movie/%d",
+	"TV Series":  "/3/tv/%d",
+	"Person":     "/3/person/%d",
+	"Collection": "/3/collection/%d",
+	"TV Network": "/3/network/%d",
+	"Keyword":    "/3/keyword/%d",
+	"Company":    "/3/company/%d",
+}
+
+// Worker Pool constants, the chunk size being the number of IDs between
+// progress messages in the log
 const numWorkers int64 = 60
 const chunkSize int64 = 3000
 
+// Default timeout for a single API request, including all of its retries
+const defaultRequestTimeout = time.Minute
+
 //---------------------------------------------------------------------------------------
 
 // Return New Instance of The Movie DB struct
-func NewMovieDB(apiKey string, exportDate string) *TheMovieDB {
+func NewMovieDB(apiKey string, exportDate string) (*TheMovieDB, error) {
+
+	utc, err := ParseExportDate(exportDate, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return newMovieDB(apiKey, utc), nil
+}
+
+// Return New Instance of The Movie DB struct for an already validated Export Date
+func newMovieDB(apiKey string, utc time.Time) *TheMovieDB {
+
+	// Initialise New Instance of The Movie DB
+	tmdb := new(TheMovieDB)
 
-	var utc time.Time
+	tmdb.APIKey = apiKey
+	tmdb.APIURL = "https://api.themoviedb.org"
+	tmdb.ExportsURL = "http://files.tmdb.org"
+	tmdb.ExportDate = utc
+	tmdb.RequestTimeout = defaultRequestTimeout
+	tmdb.Workers = numWorkers
+	tmdb.Weights = map[string]int64{}
+	tmdb.DailyExports = NewDailyExports()
+	tmdb.Started = time.Now()
+
+	return tmdb
+}
+
+// Return New Instances of every Daily Export
+func NewDailyExports() map[string]*DailyExport {
+	return map[string]*DailyExport{
+		"Movie":      {"Movie", "movie_ids", "movie_ids.json", "", "", nil},
+		"TV Series":  {"TV Series", "tv_series_ids", "tv_series_ids.json", "", "", nil},
+		"Person":     {"Person", "person_ids", "person_ids.json", "", "", nil},
+		"Collection": {"Collection", "collection_ids", "collection_ids.json", "", "", nil},
+		"TV Network": {"TV Network", "tv_network_ids", "tv_network_ids.json", "", "", nil},
+		"Keyword":    {"Keyword", "keyword_ids", "keyword_ids.json", "", "", nil},
+		"Company":    {"Company", "production_company_ids", "company_ids.json", "", "", nil},
+	}
+}
+
+// Parse and Validate the Export Date, rejecting malformed and future dates
+func ParseExportDate(exportDate string, now time.Time) (time.Time, error) {
 
 	// If no "Export Date Override" provided then we Calculate the latest date
 	// based on the following logic
 	//     The export job runs every day starting at around 7:00 AM UTC,
 	//     and all files are available by 8:00 AM UTC.
+	utc := now.UTC()
 	if exportDate == "" {
-		utc = time.Now().UTC()
 		if utc.Hour() < 8 {
 			utc = utc.Add(time.Duration(-24) * time.Hour)
 		}
-	} else {
-		utc, _ = time.Parse("2006-01-02", exportDate)
+		return time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, time.UTC), nil
 	}
 
-	// Initialise New Instance of The Movie DB
-	tmdb := new(TheMovieDB)
-
-	tmdb.APIKey = apiKey
-	tmdb.ExportDate = utc
-	tmdb.DailyExports = map[string]*DailyExport{
-		"Movie":      {"Movie", "movie_ids", "movie_ids.json", "", ""},
-		"TV Series":  {"TV Series", "tv_series_ids", "tv_series_ids.json", "", ""},
-		"Person":     {"Person", "person_ids", "person_ids.json", "", ""},
-		"Collection": {"Collection", "collection_ids", "collection_ids.json", "", ""},
-		"TV Network": {"TV Network", "tv_network_ids", "tv_network_ids.json", "", ""},
-		"Keyword":    {"Keyword", "keyword_ids", "keyword_ids.json", "", ""},
-		"Company":    {"Company", "production_company_ids", "company_ids.json", "", ""},
+	date, err := time.Parse("2006-01-02", exportDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid export date %q, expected YYYY-MM-DD: %w", exportDate, err)
+	}
+	if date.After(utc) {
+		return time.Time{}, fmt.Errorf("invalid export date %q, the date is in the future", exportDate)
 	}
 
-	return tmdb
+	return date, nil
 }
 
 //---------------------------------------------------------------------------------------
@@ -138,6 +236,74 @@ func (de DailyExport) String() string {
 
 //---------------------------------------------------------------------------------------
 
+// Find the Daily Export key for the given entity name, ignoring case and
+// accepting underscores or hyphens in place of spaces, e.g. "tv_series"
+func FindEntity(name string) (string, error) {
+	normalised := strings.NewReplacer("_", " ", "-", " ").Replace(strings.ToLower(strings.TrimSpace(name)))
+	for key := range NewDailyExports() {
+		if strings.ToLower(key) == normalised {
+			return key, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown entity %q", name)
+}
+
+// Return the file name used for the entity data, e.g. "TV Series" is "tv_series"
+func entityFileName(entity string) string {
+	return strings.ReplaceAll(strings.ToLower(entity), " ", "_")
+}
+
+// Parse a comma separated list of entity names, each of which must be one of
+// the allowed entities
+func ParseEntities(names string, allowed []string) ([]string, error) {
+	var entities []string
+	for _, name := range strings.Split(names, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		key, err := FindEntity(name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(allowed, key) {
+			return nil, fmt.Errorf("entity %q is not supported here, expected one of %v", name, allowed)
+		}
+		if !slices.Contains(entities, key) {
+			entities = append(entities, key)
+		}
+	}
+
+	return entities, nil
+}
+
+// Parse the Entity Weights given as a comma separated list, e.g. "Movie=4,Keyword=1"
+func (tmdb *TheMovieDB) ParseWeights(weights string) error {
+	for _, weight := range strings.Split(weights, ",") {
+		if strings.TrimSpace(weight) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(weight, "=")
+		if !ok {
+			return fmt.Errorf("invalid entity weight %q, expected NAME=WEIGHT", weight)
+		}
+		key, err := FindEntity(name)
+		if err != nil {
+			return err
+		}
+		w, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || w < 1 {
+			return fmt.Errorf("invalid entity weight %q, expected a positive integer", weight)
+		}
+		tmdb.Weights[key] = w
+	}
+
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
 // Validate or Create the Output Path if it does not exist
 func (tmdb *TheMovieDB) ValidateOutputPath(outputPath string) error {
 
@@ -160,27 +326,77 @@ func (tmdb *TheMovieDB) ValidateOutputPath(outputPath string) error {
 
 //---------------------------------------------------------------------------------------
 
+// Return the Path of the Daily ID Export file on the exports server
+func (tmdb *TheMovieDB) exportPath(dailyExport *DailyExport) string {
+	return fmt.Sprintf("/p/exports/%s_%s.json.gz", dailyExport.UrlPrefix, tmdb.ExportDate.Format("01_02_2006"))
+}
+
+// Check every Daily ID Export has been published, before anything is created
+// in the output path.  If requested, fall back to the previous day when the
+// export is late.
+func (tmdb *TheMovieDB) CheckDailyExports(ctx context.Context, fallback bool) error {
+
+	logger.Info().Msg("Checking the Daily ID Exports are Available")
+
+	err := tmdb.checkDailyExports(ctx)
+	if err == nil || !fallback {
+		return err
+	}
+
+	logger.Warn().Err(err).Msg("Daily ID Exports Not Available, Falling Back to the Previous Day")
+	tmdb.ExportDate = tmdb.ExportDate.AddDate(0, 0, -1)
+
+	return tmdb.checkDailyExports(ctx)
+}
+
+func (tmdb *TheMovieDB) checkDailyExports(ctx context.Context) error {
+	for _, dailyExport := range tmdb.DailyExports {
+		err := requests.
+			URL(tmdb.ExportsURL).
+			Path(tmdb.exportPath(dailyExport)).
+			Param("api_key", tmdb.APIKey).
+			Head().
+			Fetch(ctx)
+		if err != nil {
+			return fmt.Errorf("daily export %s for %s is not available: %w",
+				dailyExport.Name, tmdb.ExportDate.Format("2006-01-02"), err)
+		}
+	}
+
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
 // Get The Movie DB Daily ID Exports
-func (tmdb *TheMovieDB) GetDailyExports() error {
+func (tmdb *TheMovieDB) GetDailyExports(ctx context.Context) error {
 
 	logger.Info().Msg("Initiating Request to Get Daily ID Exports")
 
+	ctx, span := tracer.Start(ctx, "get daily exports")
+	defer span.End()
+
 	// Iterate through All of the Entries
 	for _, dailyExport := range tmdb.DailyExports {
 
-		logger.Info().Stringer("Exporting", dailyExport).Msg(indent)
+		logger.Info().Str("entity", dailyExport.MediaType).Str("file", dailyExport.Name).Msg("Downloading Daily ID Export")
 
 		// Make the Export API Request
 		var response bytes.Buffer
+		start := time.Now()
 		err := requests.
-			URL("http://files.tmdb.org").
-			Pathf("/p/exports/%s.gz", fmt.Sprintf("%s_%s.json", dailyExport.UrlPrefix, tmdb.ExportDate.Format("01_02_2006"))).
+			URL(tmdb.ExportsURL).
+			Path(tmdb.exportPath(dailyExport)).
 			Param("api_key", tmdb.APIKey).
 			ToBytesBuffer(&response).
-			Fetch(context.Background())
+			Fetch(ctx)
 		if err != nil {
+			logger.Error().Err(err).Str("entity", dailyExport.MediaType).Int("status", responseStatus(err)).
+				Int64("duration_ms", time.Since(start).Milliseconds()).Msg("Daily ID Export Download Failed")
 			return fmt.Errorf("tmdb movie API request failed: %w", err)
 		}
+		logger.Debug().Str("entity", dailyExport.MediaType).Int("status", http.StatusOK).
+			Int64("duration_ms", time.Since(start).Milliseconds()).Int("bytes", response.Len()).Msg("Downloaded Daily ID Export")
 
 		// Decompress the response data
 		gz, err := gzip.NewReader(&response)
@@ -194,10 +410,11 @@ func (tmdb *TheMovieDB) GetDailyExports() error {
 		}
 
 		dailyExport.ExportFile, _ = filepath.Abs(filepath.Join(tmdb.OutputPath, dailyExport.Name))
-		dailyExport.DataFile, _ = filepath.Abs(filepath.Join(tmdb.OutputPath,
-			fmt.Sprintf("%s.json", strings.ReplaceAll(strings.ToLower(dailyExport.MediaType), " ", "_"))))
-		err = os.WriteFile(dailyExport.ExportFile, data, 0600)
-		if err != nil {
+		dailyExport.DataFile, _ = filepath.Abs(filepath.Join(tmdb.OutputPath, fmt.Sprintf("%s%s.json", entityFileName(dailyExport.MediaType), tmdb.Shard.Suffix())))
+
+		// Write to a temporary file first so a partial file is never left
+		// behind, unique to this process as shards may share the output path
+		if err := writeFileAtomic(dailyExport.ExportFile, data); err != nil {
 			return fmt.Errorf("writing response to file failed: %w", err)
 		}
 	}
@@ -207,246 +424,203 @@ func (tmdb *TheMovieDB) GetDailyExports() error {
 	return nil
 }
 
-//---------------------------------------------------------------------------------------
-
-// Worker Pool for Concurrent HTTP API Requests
-func RequestWorker(url string, path string, apiKey string, jobs <-chan int64, results chan<- *string) {
-	// Create a New HTTP Retry Client
-	cl := httpretry.NewDefaultClient(
-		httpretry.WithMaxRetryCount(20),
-		httpretry.WithRetryPolicy(func(statusCode int, err error) bool {
-			return statusCode == 429 || err != nil || statusCode >= 500 || statusCode == 0
-		}),
-		httpretry.WithBackoffPolicy(func(attemptNum int) time.Duration {
-			return 100 * time.Millisecond
-		}),
-	)
-
-	for id := range jobs {
-		// Make the API Request
-		var response string
-		err := requests.
-			URL(url).
-			Pathf(path, id).
-			Param("api_key", apiKey).
-			Client(cl).
-			ToString(&response).
-			Fetch(context.Background())
-		if err != nil {
-			logger.Error().Err(err).Msg("API Request Failed:")
-		}
-
-		results <- &response
+// Write the file through a uniquely named temporary file renamed into place
+func writeFileAtomic(path string, data []byte) error {
+	wf, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
 	}
-}
-
-//---------------------------------------------------------------------------------------
-
-// Close the Worker Pool and Write the Results to the Output File
-func CloseWorkerPool(w *bufio.Writer, chunkCount int64, rowCount int64, jobs chan int64, results chan *string) error {
-	close(jobs)
+	defer func() { _ = os.Remove(wf.Name()) }()
 
-	for num := int64(0); num < chunkCount; num++ {
-		response := <-results
-		if _, err := fmt.Fprintf(w, "%s\n", *response); err != nil {
-			return fmt.Errorf("failed writing to the output file")
-		}
+	if _, err := wf.Write(data); err != nil {
+		_ = wf.Close()
+		return err
+	}
+	if err := wf.Close(); err != nil {
+		return err
 	}
 
-	// Output chunk message to the log
-	logger.Info().Int64("Completed Chunk:", rowCount).Msg(indent)
-
-	return nil
+	return os.Rename(wf.Name(), path)
 }
 
 //---------------------------------------------------------------------------------------
 
-// Iterate through the Daily Export ID file and Export the Movie Data
-func (tmdb *TheMovieDB) ExportMovieData() error {
-
-	logger.Info().Msg("Initiating Export of Movie Data")
-
-	dailyExport := tmdb.DailyExports["Movie"]
+// Return the Worker Pool, starting it on first use
+func (tmdb *TheMovieDB) workerPool() *WorkerPool {
+	tmdb.poolOnce.Do(func() {
+		tmdb.pool = NewWorkerPool(tmdb.Workers, tmdb.RateLimit, tmdb.Weights, tmdb.APIURL, tmdb.APIKey, tmdb.RequestTimeout)
+	})
+	return tmdb.pool
+}
 
-	//------------------------------------------------------------------
-	// Open the Output File
-	wf, err := os.Create(dailyExport.DataFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the output file: %w", err)
+// Stop the Worker Pool, if it was started
+func (tmdb *TheMovieDB) Close() {
+	tmdb.poolOnce.Do(func() {})
+	if tmdb.pool != nil {
+		tmdb.pool.Close()
 	}
-	defer func() { _ = wf.Close() }()
+}
 
-	// Ready a Buffered Writer
-	w := bufio.NewWriter(wf)
-	defer func() { _ = w.Flush() }()
+//---------------------------------------------------------------------------------------
 
-	// Open the Movie Daily Export IDs File and scan the lines
-	rf, err := os.Open(dailyExport.ExportFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
+// Return a Context bounded by the Entity Timeout, if one has been set
+func (tmdb *TheMovieDB) entityContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if tmdb.EntityTimeout > 0 {
+		return context.WithTimeout(ctx, tmdb.EntityTimeout)
 	}
-	defer func() { _ = rf.Close() }()
-
-	r := bufio.NewScanner(rf)
-	r.Split(bufio.ScanLines)
-
-	//------------------------------------------------------------------
-	// Setup the Worker Pool for the given chunk size
-	var jobs chan int64
-	var results chan *string
-
-	//------------------------------------------------------------------
-	// Iterate through All of the Movie Export IDs
-	var rowCount int64 = 0
-	var chunkCount int64 = 0
-	for r.Scan() {
-
-		// Start workers if new Chunk
-		if chunkCount == 0 {
-			jobs = make(chan int64, chunkSize)
-			results = make(chan *string, chunkSize)
-
-			for num := int64(0); num < numWorkers; num++ {
-				go RequestWorker("https://api.themoviedb.org", "/3/movie/%d", tmdb.APIKey, jobs, results)
-			}
-		}
-
-		// Read the next line of the file
-		line := []byte(r.Text())
-
-		// Unmarshal the JSON data contained in the line
-		movieExport := new(MovieExport)
-		if err := json.Unmarshal(line, &movieExport); err != nil {
-			return fmt.Errorf("failed to unmarshal the movie export JSON data: %w", err)
-		}
-
-		// Add to the Worker Pool
-		jobs <- movieExport.Id
-
-		chunkCount++
-		rowCount++
+	return context.WithCancel(ctx)
+}
 
-		// When you reach the max chunk size, wait for the Worker Pool to complete
-		// all of the jobs and write the response to the output file
-		if chunkCount == chunkSize {
-			if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-				return fmt.Errorf("close worker pool failed: %w", err)
-			}
-			chunkCount = 0
+// Return a Context bounded by the Entity Time Box and Run Deadline, if set,
+// used to stop dispatching new IDs without cancelling the in-flight requests
+func (tmdb *TheMovieDB) timeBoxContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline := tmdb.RunDeadline
+	if tmdb.EntityTimeBox > 0 {
+		if d := time.Now().Add(tmdb.EntityTimeBox); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
 		}
 	}
-
-	// When you reach the max chunk size, wait for the Worker Pool to complete
-	// all of the jobs and write the response to the output file
-	if chunkCount > 0 {
-		if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-			return fmt.Errorf("close worker pool failed: %w", err)
-		}
+	if !deadline.IsZero() {
+		return context.WithDeadline(ctx, deadline)
 	}
+	return context.WithCancel(ctx)
+}
 
-	logger.Info().Int64("Number of Movie Records Exported", rowCount).Msg(indent)
+// Request Budget of an entity export, sharing the run budget with the other
+// exports.  Dispatching an ID takes one request for its first attempt and
+// each retry takes another, so the HTTP requests made never exceed either.
+type requestBudget struct {
+	tmdb *TheMovieDB
 
-	return nil
+	mu        sync.Mutex
+	used      int64
+	exhausted string
 }
 
-//---------------------------------------------------------------------------------------
+type requestBudgetKey struct{}
 
-// Iterate through the Daily Export ID file and Export the TV Series Data
-func (tmdb *TheMovieDB) ExportTVSeriesData() error {
+var errBudgetExhausted = errors.New("request budget exhausted")
 
-	logger.Info().Msg("Initiating Export of TV Series Data")
+func (tmdb *TheMovieDB) newRequestBudget() *requestBudget {
+	return &requestBudget{tmdb: tmdb}
+}
 
-	dailyExport := tmdb.DailyExports["TV Series"]
+// Return the context carrying the budget, so the retries of each API request
+// made for the export are taken from it
+func (budget *requestBudget) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestBudgetKey{}, budget)
+}
 
-	//------------------------------------------------------------------
-	// Open the Output File
-	wf, err := os.Create(dailyExport.DataFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the output file: %w", err)
+// Take one request from the budget, returning the budget exhausted, if any
+func (budget *requestBudget) take() string {
+	if budget == nil {
+		return ""
 	}
-	defer func() { _ = wf.Close() }()
 
-	// Ready a Buffered Writer
-	w := bufio.NewWriter(wf)
-	defer func() { _ = w.Flush() }()
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
 
-	// Open the TV Series Daily Export IDs File and scan the lines
-	rf, err := os.Open(dailyExport.ExportFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
+	tmdb := budget.tmdb
+	switch {
+	case tmdb.EntityBudget > 0 && budget.used >= tmdb.EntityBudget:
+		budget.exhausted = "entity requests"
+	case tmdb.RunBudget > 0 && tmdb.runRequests.Add(1) > tmdb.RunBudget:
+		budget.exhausted = "run requests"
+	default:
+		budget.used++
+		return ""
 	}
-	defer func() { _ = rf.Close() }()
-
-	r := bufio.NewScanner(rf)
-	r.Split(bufio.ScanLines)
-
-	//------------------------------------------------------------------
-	// Setup the Worker Pool for the given chunk size
-	var jobs chan int64
-	var results chan *string
-
-	//------------------------------------------------------------------
-	// Iterate through All of the TV Series Export IDs
-	var rowCount int64 = 0
-	var chunkCount int64 = 0
-	for r.Scan() {
-
-		// Start workers if new Chunk
-		if chunkCount == 0 {
-			jobs = make(chan int64, chunkSize)
-			results = make(chan *string, chunkSize)
 
-			for num := int64(0); num < numWorkers; num++ {
-				go RequestWorker("https://api.themoviedb.org", "/3/tv/%d", tmdb.APIKey, jobs, results)
-			}
-		}
+	return budget.exhausted
+}
 
-		// Read the next line of the file
-		line := []byte(r.Text())
+// Return the budget exhausted, if any
+func (budget *requestBudget) exhaustedBy() string {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	return budget.exhausted
+}
 
-		// Unmarshal the JSON data contained in the line
-		tvSeriesExport := new(TVSeriesExport)
-		if err := json.Unmarshal(line, &tvSeriesExport); err != nil {
-			return fmt.Errorf("failed to unmarshal the TV series export JSON data: %w", err)
-		}
+// Return true once the run budget has been used up by the earlier exports
+func (tmdb *TheMovieDB) runBudgetExhausted() bool {
+	return tmdb.RunBudget > 0 && tmdb.runRequests.Load() >= tmdb.RunBudget
+}
 
-		// Add to the Worker Pool
-		jobs <- tvSeriesExport.Id
+//---------------------------------------------------------------------------------------
 
-		chunkCount++
-		rowCount++
+// Write the Progress of each Export to the Output Path, used to record how far
+// an interrupted run got, with the file name suffixed by the shard if any
+func (tmdb *TheMovieDB) WriteProgress() error {
 
-		// When you reach the max chunk size, wait for the Worker Pool to complete
-		// all of the jobs and write the response to the output file
-		if chunkCount == chunkSize {
-			if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-				return fmt.Errorf("close worker pool failed: %w", err)
-			}
-			chunkCount = 0
+	progress := map[string]*ExportProgress{}
+	for _, dailyExport := range tmdb.DailyExports {
+		if dailyExport.Progress != nil {
+			progress[dailyExport.MediaType] = dailyExport.Progress
 		}
 	}
+	if len(progress) == 0 {
+		return nil
+	}
 
-	// When you reach the max chunk size, wait for the Worker Pool to complete
-	// all of the jobs and write the response to the output file
-	if chunkCount > 0 {
-		if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-			return fmt.Errorf("close worker pool failed: %w", err)
-		}
+	data, err := json.MarshalIndent(progress, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal the export progress: %w", err)
 	}
 
-	logger.Info().Int64("Number of TV Series Records Exported", rowCount).Msg(indent)
+	name := tmdb.progressFile
+	if name == "" {
+		name = filepath.Join(tmdb.OutputPath, fmt.Sprintf("progress%s.json", tmdb.Shard.Suffix()))
+	}
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		return fmt.Errorf("failed to write the export progress file: %w", err)
+	}
 
 	return nil
 }
 
 //---------------------------------------------------------------------------------------
 
-// Iterate through the Daily Export ID file and Export the Person Data
-func (tmdb *TheMovieDB) ExportPersonData() error {
-
-	logger.Info().Msg("Initiating Export of Person Data")
-
-	dailyExport := tmdb.DailyExports["Person"]
+// Iterate through the Daily Export ID file, dispatching each ID matching the
+// filter and sample to the Worker Pool and streaming the results to the
+// output file as they complete.  With popularity order set the IDs are
+// dispatched most popular first, so an export cut short has the most
+// important records.  Once a request budget or time box is exhausted no
+// further IDs are dispatched and the export completes with the records it has.
+func (tmdb *TheMovieDB) exportData(ctx context.Context, key string, parseID func(line []byte) (ExportID, error)) (err error) {
+
+	logger.Info().Str("entity", key).Msgf("Initiating Export of %s Data", key)
+
+	started := time.Now()
+	dailyExport := tmdb.DailyExports[key]
+
+	// Track the Progress of the Export
+	progress := &ExportProgress{Sampled: tmdb.Sample != nil}
+	dailyExport.Progress = progress
+
+	ctx, span := tracer.Start(ctx, "export", trace.WithAttributes(attribute.String("entity", key)))
+	defer func() {
+		span.SetAttributes(
+			attribute.Int64("ids_read", progress.IDsRead),
+			attribute.Int64("records_exported", progress.RecordsExported),
+			attribute.Int64("failed", progress.Failed),
+			attribute.Int64("filtered", progress.Filtered),
+		)
+		endSpan(span, err)
+	}()
+
+	// Bound the Export by the Entity Timeout, if one has been set
+	ctx, cancel := tmdb.entityContext(ctx)
+	defer cancel()
+
+	// Leave the data file untouched when the earlier exports used up the
+	// run budget
+	if tmdb.runBudgetExhausted() {
+		progress.BudgetExhausted = "run requests"
+		logger.Warn().Str("entity", key).Str("budget", progress.BudgetExhausted).Int64("completed", 0).Msg("Budget Exhausted")
+		return nil
+	}
+	budget := tmdb.newRequestBudget()
+	ctx = budget.context(ctx)
 
 	//------------------------------------------------------------------
 	// Open the Output File
@@ -460,7 +634,7 @@ func (tmdb *TheMovieDB) ExportPersonData() error {
 	w := bufio.NewWriter(wf)
 	defer func() { _ = w.Flush() }()
 
-	// Open the Person Daily Export IDs File and scan the lines
+	// Open the Daily Export IDs File and scan the lines
 	rf, err := os.Open(dailyExport.ExportFile)
 	if err != nil {
 		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
@@ -470,421 +644,308 @@ func (tmdb *TheMovieDB) ExportPersonData() error {
 	r := bufio.NewScanner(rf)
 	r.Split(bufio.ScanLines)
 
-	//------------------------------------------------------------------
-	// Setup the Worker Pool for the given chunk size
-	var jobs chan int64
-	var results chan *string
+	// Expect every ID to be crawled until they have all been dispatched
+	lines, err := countLines(dailyExport.ExportFile)
+	if err != nil {
+		return err
+	}
+	metrics := newExportMetrics(key, lines)
+	defer metrics.finish()
+	tmdb.addExportMetrics(metrics)
+	ctx = metrics.context(ctx)
 
 	//------------------------------------------------------------------
-	// Iterate through All of the Person Export IDs
-	var rowCount int64 = 0
-	var chunkCount int64 = 0
-	for r.Scan() {
+	// Dispatch All of the Export IDs to the Worker Pool
+	pool := tmdb.workerPool()
+	results := make(chan *RequestResult, tmdb.Workers)
+	dispatched := make(chan dispatchResult, 1)
+
+	// Stop dispatching new IDs, but let the in-flight requests finish, once
+	// a time box has ended
+	dispatchCtx, cancelDispatch := tmdb.timeBoxContext(ctx)
+	defer cancelDispatch()
+
+	go func() {
+		var count int64
+		var exhausted string
+		var chunk *traceChunk
+		submit := func(id ExportID) bool {
+
+			// Stop dispatching new IDs once a shutdown has been requested
+			if dispatchCtx.Err() != nil {
+				return false
+			}
+			if exhausted = budget.take(); exhausted != "" {
+				return false
+			}
 
-		// Start workers if new Chunk
-		if chunkCount == 0 {
-			jobs = make(chan int64, chunkSize)
-			results = make(chan *string, chunkSize)
+			// Trace the IDs in chunks, in the order they are dispatched
+			if chunk == nil {
+				chunk = startTraceChunk(ctx, key, count/chunkSize)
+			}
+			chunk.add()
 
-			for num := int64(0); num < numWorkers; num++ {
-				go RequestWorker("https://api.themoviedb.org", "/3/person/%d", tmdb.APIKey, jobs, results)
+			job := &RequestJob{Ctx: chunk.ctx, Entity: key, Id: id.Id, Path: entityAPIPaths[key], Results: results}
+			if err := pool.Submit(dispatchCtx, job); err != nil {
+				chunk.cancel()
+				return false
 			}
+			count++
+			if count%chunkSize == 0 {
+				chunk.seal()
+				chunk = nil
+			}
+			return true
 		}
-
-		// Read the next line of the file
-		line := []byte(r.Text())
-
-		// Unmarshal the JSON data contained in the line
-		personExport := new(PersonExport)
-		if err := json.Unmarshal(line, &personExport); err != nil {
-			return fmt.Errorf("failed to unmarshal the person export JSON data: %w", err)
+		done := func(filtered int64, err error) {
+			if chunk != nil {
+				chunk.seal()
+			}
+			if exhausted == "" && ctx.Err() == nil && dispatchCtx.Err() != nil {
+				exhausted = "time box"
+			}
+			dispatched <- dispatchResult{count, filtered, exhausted, err}
 		}
 
-		// Add to the Worker Pool
-		jobs <- personExport.Id
+		// Either dispatch the IDs in file order as they are read, or read them
+		// all to select a sample of a number of IDs and dispatch the most
+		// popular first
+		if !tmdb.PopularityOrder && !tmdb.Sample.limited() {
+			done(tmdb.scanExportIDs(key, r, parseID, submit))
+			return
+		}
 
-		chunkCount++
-		rowCount++
+		var ids []ExportID
+		filtered, err := tmdb.scanExportIDs(key, r, parseID, func(id ExportID) bool {
+			ids = append(ids, id)
+			return true
+		})
+		if err == nil {
+			selected := tmdb.Sample.Select(ids)
+			filtered += int64(len(ids) - len(selected))
+			ids = selected
 
-		// When you reach the max chunk size, wait for the Worker Pool to complete
-		// all of the jobs and write the response to the output file
-		if chunkCount == chunkSize {
-			if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-				return fmt.Errorf("close worker pool failed: %w", err)
+			if tmdb.PopularityOrder {
+				slices.SortStableFunc(ids, func(a, b ExportID) int { return cmp.Compare(b.Popularity, a.Popularity) })
+			}
+			for _, id := range ids {
+				if !submit(id) {
+					break
+				}
 			}
-			chunkCount = 0
 		}
-	}
+		done(filtered, err)
+	}()
 
-	// When you reach the max chunk size, wait for the Worker Pool to complete
-	// all of the jobs and write the response to the output file
-	if chunkCount > 0 {
-		if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-			return fmt.Errorf("close worker pool failed: %w", err)
+	//------------------------------------------------------------------
+	// Write the Results to the Output File as they arrive, always draining
+	// every dispatched job so no worker is left blocked on the results
+	var dispatchErr, writeErr error
+	var total int64 = -1
+	var received int64 = 0
+	for total < 0 || received < total {
+		select {
+		case d := <-dispatched:
+			total, dispatchErr = d.count, d.err
+			progress.IDsRead = total + d.filtered
+			progress.Filtered = d.filtered
+			progress.BudgetExhausted = d.budget
+			metrics.setExpected(total)
+			dispatched = nil
+
+		case result := <-results:
+			received++
+			metrics.record(result)
+			if writeErr != nil {
+				result.finishChunk(0)
+				continue
+			}
+			start := time.Now()
+			writeErr = writeResult(w, progress, result)
+			result.finishChunk(time.Since(start))
+			if writeErr != nil {
+				cancel()
+				continue
+			}
+
+			// Output progress message to the log
+			if received%chunkSize == 0 {
+				logger.Info().Str("entity", key).Int64("completed", received).
+					Int64("duration_ms", time.Since(started).Milliseconds()).Msg("Completed Chunk")
+			}
 		}
 	}
 
-	logger.Info().Int64("Number of Person Records Exported", rowCount).Msg(indent)
-
-	return nil
-}
-
-//---------------------------------------------------------------------------------------
-
-// Iterate through the Daily Export ID file and Export the Collection Data
-func (tmdb *TheMovieDB) ExportCollectionData() error {
-
-	logger.Info().Msg("Initiating Export of Collection Data")
-
-	dailyExport := tmdb.DailyExports["Collection"]
+	if dispatchErr != nil {
+		return dispatchErr
+	}
+	if writeErr != nil {
+		return writeErr
+	}
 
-	//------------------------------------------------------------------
-	// Open the Output File
-	wf, err := os.Create(dailyExport.DataFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the output file: %w", err)
+	// Record why the export stopped early once the in-flight requests have been written
+	if err := ctx.Err(); err != nil {
+		progress.Interrupted = errors.Is(err, context.Canceled)
+		progress.TimedOut = errors.Is(err, context.DeadlineExceeded)
+		logger.Warn().Str("entity", key).Int64("completed", received).Int64("skipped", progress.Skipped).Msg("Export Interrupted")
+		return fmt.Errorf("%s export interrupted: %w", key, err)
 	}
-	defer func() { _ = wf.Close() }()
 
-	// Ready a Buffered Writer
-	w := bufio.NewWriter(wf)
-	defer func() { _ = w.Flush() }()
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed writing to the output file: %w", err)
+	}
 
-	// Open the Collection Daily Export IDs File and scan the lines
-	rf, err := os.Open(dailyExport.ExportFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
+	// A retry refused by the budget exhausts it too
+	if progress.BudgetExhausted == "" {
+		progress.BudgetExhausted = budget.exhaustedBy()
 	}
-	defer func() { _ = rf.Close() }()
+	if progress.BudgetExhausted != "" {
+		logger.Warn().Str("entity", key).Str("budget", progress.BudgetExhausted).Int64("completed", received).Msg("Budget Exhausted")
+	}
+	logger.Info().Str("entity", key).Int64("exported", progress.RecordsExported).Int64("failed", progress.Failed).
+		Int64("filtered", progress.Filtered).Int64("duration_ms", time.Since(started).Milliseconds()).Msgf("Completed Export of %s Data", key)
 
-	r := bufio.NewScanner(rf)
-	r.Split(bufio.ScanLines)
+	return nil
+}
 
-	//------------------------------------------------------------------
-	// Setup the Worker Pool for the given chunk size
-	var jobs chan int64
-	var results chan *string
+type dispatchResult struct {
+	count    int64
+	filtered int64
+	budget   string
+	err      error
+}
 
-	//------------------------------------------------------------------
-	// Iterate through All of the Collection Export IDs
-	var rowCount int64 = 0
-	var chunkCount int64 = 0
+// Scan the Daily Export ID file calling fn with each ID of the shard matching
+// the filter and percentage sample, until fn returns false, and return the
+// number of IDs filtered out, the IDs of other shards are not counted
+func (tmdb *TheMovieDB) scanExportIDs(key string, r *bufio.Scanner, parseID func(line []byte) (ExportID, error), fn func(id ExportID) bool) (int64, error) {
+	var filtered int64
 	for r.Scan() {
-
-		// Start workers if new Chunk
-		if chunkCount == 0 {
-			jobs = make(chan int64, chunkSize)
-			results = make(chan *string, chunkSize)
-
-			for num := int64(0); num < numWorkers; num++ {
-				go RequestWorker("https://api.themoviedb.org", "/3/collection/%d", tmdb.APIKey, jobs, results)
-			}
+		id, err := parseID(r.Bytes())
+		if err != nil {
+			return filtered, err
 		}
-
-		// Read the next line of the file
-		line := []byte(r.Text())
-
-		// Unmarshal the JSON data contained in the line
-		collectionExport := new(CollectionExport)
-		if err := json.Unmarshal(line, &collectionExport); err != nil {
-			return fmt.Errorf("failed to unmarshal the collection export JSON data: %w", err)
+		if !tmdb.Shard.Match(id.Id) {
+			continue
 		}
-
-		// Add to the Worker Pool
-		jobs <- collectionExport.Id
-
-		chunkCount++
-		rowCount++
-
-		// When you reach the max chunk size, wait for the Worker Pool to complete
-		// all of the jobs and write the response to the output file
-		if chunkCount == chunkSize {
-			if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-				return fmt.Errorf("close worker pool failed: %w", err)
-			}
-			chunkCount = 0
+		if !tmdb.Filter.Match(key, id) || !tmdb.Sample.Match(id.Id) {
+			filtered++
+			continue
+		}
+		if !fn(id) {
+			return filtered, nil
 		}
 	}
 
-	// When you reach the max chunk size, wait for the Worker Pool to complete
-	// all of the jobs and write the response to the output file
-	if chunkCount > 0 {
-		if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-			return fmt.Errorf("close worker pool failed: %w", err)
+	return filtered, r.Err()
+}
+
+// Write a single Result to the Output File, skipped and failed requests are
+// counted but not written.  A request whose retry was refused by the budget
+// counts as skipped.
+func writeResult(w *bufio.Writer, progress *ExportProgress, result *RequestResult) error {
+	switch {
+	case result == nil || errors.Is(result.Err, errBudgetExhausted):
+		progress.Skipped++
+	case result.Err != nil:
+		progress.Failed++
+	default:
+		if _, err := fmt.Fprintf(w, "%s\n", result.Response); err != nil {
+			return fmt.Errorf("failed writing to the output file: %w", err)
 		}
+		progress.RecordsExported++
 	}
 
-	logger.Info().Int64("Number of Collection Records Exported", rowCount).Msg(indent)
-
 	return nil
 }
 
 //---------------------------------------------------------------------------------------
 
-// Iterate through the Daily Export ID file and Export the TV Network Data
-func (tmdb *TheMovieDB) ExportTVNetworkData() error {
-
-	logger.Info().Msg("Initiating Export of TV Network Data")
-
-	dailyExport := tmdb.DailyExports["TV Network"]
-
-	//------------------------------------------------------------------
-	// Open the Output File
-	wf, err := os.Create(dailyExport.DataFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the output file: %w", err)
-	}
-	defer func() { _ = wf.Close() }()
-
-	// Ready a Buffered Writer
-	w := bufio.NewWriter(wf)
-	defer func() { _ = w.Flush() }()
+// Iterate through the Daily Export ID file and Export the Movie Data
+func (tmdb *TheMovieDB) ExportMovieData(ctx context.Context) error {
+	return tmdb.exportData(ctx, "Movie", func(line []byte) (ExportID, error) {
+		movieExport := new(MovieExport)
+		if err := json.Unmarshal(line, &movieExport); err != nil {
+			return ExportID{}, fmt.Errorf("failed to unmarshal the movie export JSON data: %w", err)
+		}
+		return ExportID{Id: movieExport.Id, Popularity: movieExport.Popularity, Adult: movieExport.Adult, Video: movieExport.Video}, nil
+	})
+}
 
-	// Open the TV Network Daily Export IDs File and scan the lines
-	rf, err := os.Open(dailyExport.ExportFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
-	}
-	defer func() { _ = rf.Close() }()
+//---------------------------------------------------------------------------------------
 
-	r := bufio.NewScanner(rf)
-	r.Split(bufio.ScanLines)
+// Iterate through the Daily Export ID file and Export the TV Series Data
+func (tmdb *TheMovieDB) ExportTVSeriesData(ctx context.Context) error {
+	return tmdb.exportData(ctx, "TV Series", func(line []byte) (ExportID, error) {
+		tvSeriesExport := new(TVSeriesExport)
+		if err := json.Unmarshal(line, &tvSeriesExport); err != nil {
+			return ExportID{}, fmt.Errorf("failed to unmarshal the TV series export JSON data: %w", err)
+		}
+		return ExportID{Id: tvSeriesExport.Id, Popularity: tvSeriesExport.Popularity}, nil
+	})
+}
 
-	//------------------------------------------------------------------
-	// Setup the Worker Pool for the given chunk size
-	var jobs chan int64
-	var results chan *string
+//---------------------------------------------------------------------------------------
 
-	//------------------------------------------------------------------
-	// Iterate through All of the TV Network Export IDs
-	var rowCount int64 = 0
-	var chunkCount int64 = 0
-	for r.Scan() {
+// Iterate through the Daily Export ID file and Export the Person Data
+func (tmdb *TheMovieDB) ExportPersonData(ctx context.Context) error {
+	return tmdb.exportData(ctx, "Person", func(line []byte) (ExportID, error) {
+		personExport := new(PersonExport)
+		if err := json.Unmarshal(line, &personExport); err != nil {
+			return ExportID{}, fmt.Errorf("failed to unmarshal the person export JSON data: %w", err)
+		}
+		return ExportID{Id: personExport.Id, Popularity: personExport.Popularity, Adult: personExport.Adult}, nil
+	})
+}
 
-		// Start workers if new Chunk
-		if chunkCount == 0 {
-			jobs = make(chan int64, chunkSize)
-			results = make(chan *string, chunkSize)
+//---------------------------------------------------------------------------------------
 
-			for num := int64(0); num < numWorkers; num++ {
-				go RequestWorker("https://api.themoviedb.org", "/3/network/%d", tmdb.APIKey, jobs, results)
-			}
+// Iterate through the Daily Export ID file and Export the Collection Data
+func (tmdb *TheMovieDB) ExportCollectionData(ctx context.Context) error {
+	return tmdb.exportData(ctx, "Collection", func(line []byte) (ExportID, error) {
+		collectionExport := new(CollectionExport)
+		if err := json.Unmarshal(line, &collectionExport); err != nil {
+			return ExportID{}, fmt.Errorf("failed to unmarshal the collection export JSON data: %w", err)
 		}
+		return ExportID{Id: collectionExport.Id}, nil
+	})
+}
 
-		// Read the next line of the file
-		line := []byte(r.Text())
+//---------------------------------------------------------------------------------------
 
-		// Unmarshal the JSON data contained in the line
+// Iterate through the Daily Export ID file and Export the TV Network Data
+func (tmdb *TheMovieDB) ExportTVNetworkData(ctx context.Context) error {
+	return tmdb.exportData(ctx, "TV Network", func(line []byte) (ExportID, error) {
 		tvNetworkExport := new(TVNetworkExport)
 		if err := json.Unmarshal(line, &tvNetworkExport); err != nil {
-			return fmt.Errorf("failed to unmarshal the TV network export JSON data: %w", err)
-		}
-
-		// Add to the Worker Pool
-		jobs <- tvNetworkExport.Id
-
-		chunkCount++
-		rowCount++
-
-		// When you reach the max chunk size, wait for the Worker Pool to complete
-		// all of the jobs and write the response to the output file
-		if chunkCount == chunkSize {
-			if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-				return fmt.Errorf("close worker pool failed: %w", err)
-			}
-			chunkCount = 0
-		}
-	}
-
-	// When you reach the max chunk size, wait for the Worker Pool to complete
-	// all of the jobs and write the response to the output file
-	if chunkCount > 0 {
-		if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-			return fmt.Errorf("close worker pool failed: %w", err)
+			return ExportID{}, fmt.Errorf("failed to unmarshal the TV network export JSON data: %w", err)
 		}
-	}
-
-	logger.Info().Int64("Number of TV Network Records Exported", rowCount).Msg(indent)
-
-	return nil
+		return ExportID{Id: tvNetworkExport.Id}, nil
+	})
 }
 
 //---------------------------------------------------------------------------------------
 
 // Iterate through the Daily Export ID file and Export the Keyword Data
-func (tmdb *TheMovieDB) ExportKeywordData() error {
-
-	logger.Info().Msg("Initiating Export of Keyword Data")
-
-	dailyExport := tmdb.DailyExports["Keyword"]
-
-	//------------------------------------------------------------------
-	// Open the Output File
-	wf, err := os.Create(dailyExport.DataFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the output file: %w", err)
-	}
-	defer func() { _ = wf.Close() }()
-
-	// Ready a Buffered Writer
-	w := bufio.NewWriter(wf)
-	defer func() { _ = w.Flush() }()
-
-	// Open the Keyword Daily Export IDs File and scan the lines
-	rf, err := os.Open(dailyExport.ExportFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
-	}
-	defer func() { _ = rf.Close() }()
-
-	r := bufio.NewScanner(rf)
-	r.Split(bufio.ScanLines)
-
-	//------------------------------------------------------------------
-	// Setup the Worker Pool for the given chunk size
-	var jobs chan int64
-	var results chan *string
-
-	//------------------------------------------------------------------
-	// Iterate through All of the Keyword Export IDs
-	var rowCount int64 = 0
-	var chunkCount int64 = 0
-	for r.Scan() {
-
-		// Start workers if new Chunk
-		if chunkCount == 0 {
-			jobs = make(chan int64, chunkSize)
-			results = make(chan *string, chunkSize)
-
-			for num := int64(0); num < numWorkers; num++ {
-				go RequestWorker("https://api.themoviedb.org", "/3/keyword/%d", tmdb.APIKey, jobs, results)
-			}
-		}
-
-		// Read the next line of the file
-		line := []byte(r.Text())
-
-		// Unmarshal the JSON data contained in the line
+func (tmdb *TheMovieDB) ExportKeywordData(ctx context.Context) error {
+	return tmdb.exportData(ctx, "Keyword", func(line []byte) (ExportID, error) {
 		keywordExport := new(KeywordExport)
 		if err := json.Unmarshal(line, &keywordExport); err != nil {
-			return fmt.Errorf("failed to unmarshal the keyword export JSON data: %w", err)
+			return ExportID{}, fmt.Errorf("failed to unmarshal the keyword export JSON data: %w", err)
 		}
-
-		// Add to the Worker Pool
-		jobs <- keywordExport.Id
-
-		chunkCount++
-		rowCount++
-
-		// When you reach the max chunk size, wait for the Worker Pool to complete
-		// all of the jobs and write the response to the output file
-		if chunkCount == chunkSize {
-			if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-				return fmt.Errorf("close worker pool failed: %w", err)
-			}
-			chunkCount = 0
-		}
-	}
-
-	// When you reach the max chunk size, wait for the Worker Pool to complete
-	// all of the jobs and write the response to the output file
-	if chunkCount > 0 {
-		if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-			return fmt.Errorf("close worker pool failed: %w", err)
-		}
-	}
-
-	logger.Info().Int64("Number of Keyword Records Exported", rowCount).Msg(indent)
-
-	return nil
+		return ExportID{Id: keywordExport.Id}, nil
+	})
 }
 
 //---------------------------------------------------------------------------------------
 
 // Iterate through the Daily Export ID file and Export the Company Data
-func (tmdb *TheMovieDB) ExportCompanyData() error {
-
-	logger.Info().Msg("Initiating Export of Company Data")
-
-	dailyExport := tmdb.DailyExports["Company"]
-
-	//------------------------------------------------------------------
-	// Open the Output File
-	wf, err := os.Create(dailyExport.DataFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the output file: %w", err)
-	}
-	defer func() { _ = wf.Close() }()
-
-	// Ready a Buffered Writer
-	w := bufio.NewWriter(wf)
-	defer func() { _ = w.Flush() }()
-
-	// Open the Company Daily Export IDs File and scan the lines
-	rf, err := os.Open(dailyExport.ExportFile)
-	if err != nil {
-		return fmt.Errorf("failed to open the daily export IDs file: %w", err)
-	}
-	defer func() { _ = rf.Close() }()
-
-	r := bufio.NewScanner(rf)
-	r.Split(bufio.ScanLines)
-
-	//------------------------------------------------------------------
-	// Setup the Worker Pool for the given chunk size
-	var jobs chan int64
-	var results chan *string
-
-	//------------------------------------------------------------------
-	// Iterate through All of the Company Export IDs
-	var rowCount int64 = 0
-	var chunkCount int64 = 0
-	for r.Scan() {
-
-		// Start workers if new Chunk
-		if chunkCount == 0 {
-			jobs = make(chan int64, chunkSize)
-			results = make(chan *string, chunkSize)
-
-			for num := int64(0); num < numWorkers; num++ {
-				go RequestWorker("https://api.themoviedb.org", "/3/company/%d", tmdb.APIKey, jobs, results)
-			}
-		}
-
-		// Read the next line of the file
-		line := []byte(r.Text())
-
-		// Unmarshal the JSON data contained in the line
+func (tmdb *TheMovieDB) ExportCompanyData(ctx context.Context) error {
+	return tmdb.exportData(ctx, "Company", func(line []byte) (ExportID, error) {
 		companyExport := new(CompanyExport)
 		if err := json.Unmarshal(line, &companyExport); err != nil {
-			return fmt.Errorf("failed to unmarshal the company export JSON data: %w", err)
+			return ExportID{}, fmt.Errorf("failed to unmarshal the company export JSON data: %w", err)
 		}
-
-		// Add to the Worker Pool
-		jobs <- companyExport.Id
-
-		chunkCount++
-		rowCount++
-
-		// When you reach the max chunk size, wait for the Worker Pool to complete
-		// all of the jobs and write the response to the output file
-		if chunkCount == chunkSize {
-			if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-				return fmt.Errorf("close worker pool failed: %w", err)
-			}
-			chunkCount = 0
-		}
-	}
-
-	// When you reach the max chunk size, wait for the Worker Pool to complete
-	// all of the jobs and write the response to the output file
-	if chunkCount > 0 {
-		if err := CloseWorkerPool(w, chunkCount, rowCount, jobs, results); err != nil {
-			return fmt.Errorf("close worker pool failed: %w", err)
-		}
-	}
-
-	logger.Info().Int64("Number of Company Records Exported", rowCount).Msg(indent)
-
-	return nil
+		return ExportID{Id: companyExport.Id}, nil
+	})
 }
@@ -0,0 +1,871 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const testExportDate = "2024-05-01"
+
+// Stand-in for both files.tmdb.org and api.themoviedb.org
+type fakeTMDB struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	exports  map[string][]byte                  // UrlPrefix -> raw (uncompressed) ID file
+	raw      map[string][]byte                  // UrlPrefix -> response body served as-is
+	attempts map[string]int                     // API path -> number of requests seen
+	dates    map[string]bool                    // published export dates, MM_DD_YYYY
+	status   func(path string, attempt int) int // optional API status override
+	delay    func(path string) time.Duration    // optional API response delay
+	conns    atomic.Int64                       // number of connections opened
+}
+
+var apiPathPattern = regexp.MustCompile(`^/3/([a-z]+)/(\d+)$`)
+
+func newFakeTMDB(t *testing.T) *fakeTMDB {
+	t.Helper()
+
+	f := &fakeTMDB{
+		exports:  map[string][]byte{},
+		raw:      map[string][]byte{},
+		attempts: map[string]int{},
+		dates:    map[string]bool{"05_01_2024": true},
+	}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serveHTTP))
+	f.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.conns.Add(1)
+		}
+	}
+	f.Start()
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeTMDB) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("api_key") != "test-key" {
+		http.Error(w, "missing api key", http.StatusUnauthorized)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/p/exports/") {
+		f.serveExport(w, r)
+		return
+	}
+
+	m := apiPathPattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	f.attempts[r.URL.Path]++
+	attempt := f.attempts[r.URL.Path]
+	status := f.status
+	delay := f.delay
+	f.mu.Unlock()
+
+	if delay != nil {
+		select {
+		case <-time.After(delay(r.URL.Path)):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if status != nil {
+		if code := status(r.URL.Path, attempt); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"id":%s,"kind":%q}`, m[2], m[1])
+}
+
+func (f *fakeTMDB) serveExport(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/p/exports/"), ".json.gz")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(name) < 11 || !f.dates[name[len(name)-10:]] {
+		http.NotFound(w, r)
+		return
+	}
+	prefix := name[:len(name)-11]
+
+	if body, ok := f.raw[prefix]; ok {
+		_, _ = w.Write(body)
+		return
+	}
+
+	data, ok := f.exports[prefix]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	gz := gzip.NewWriter(w)
+	_, _ = gz.Write(data)
+	_ = gz.Close()
+}
+
+// Set the ID file for the given prefix to n sequential movie style records
+func (f *fakeTMDB) setIDs(prefix string, n int) {
+	var b bytes.Buffer
+	for id := 1; id <= n; id++ {
+		fmt.Fprintf(&b, `{"adult":false,"id":%d,"original_title":"Title %d","popularity":%d.5,"video":false}`+"\n", id, id, id)
+	}
+	f.setExport(prefix, b.Bytes())
+}
+
+func (f *fakeTMDB) setExport(prefix string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.exports[prefix] = data
+}
+
+func (f *fakeTMDB) setAllIDs(n int) {
+	for _, prefix := range []string{"movie_ids", "tv_series_ids", "person_ids", "collection_ids",
+		"tv_network_ids", "keyword_ids", "production_company_ids"} {
+		f.setIDs(prefix, n)
+	}
+}
+
+func (f *fakeTMDB) attemptsFor(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attempts[path]
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestMain(m *testing.M) {
+	logger = zerolog.Nop()
+	os.Exit(m.Run())
+}
+
+// Return a TheMovieDB for the test export date
+func testMovieDB(t *testing.T) *TheMovieDB {
+	t.Helper()
+
+	tmdb, err := NewMovieDB("test-key", testExportDate)
+	if err != nil {
+		t.Fatalf("NewMovieDB() error = %v", err)
+	}
+
+	return tmdb
+}
+
+// Return a TheMovieDB pointed at the fake server with the Daily ID Exports downloaded
+func newTestMovieDB(t *testing.T, f *fakeTMDB) *TheMovieDB {
+	t.Helper()
+
+	tmdb := testMovieDB(t)
+	tmdb.APIURL = f.URL
+	tmdb.ExportsURL = f.URL
+	t.Cleanup(tmdb.Close)
+
+	if err := tmdb.ValidateOutputPath(t.TempDir()); err != nil {
+		t.Fatalf("ValidateOutputPath() error = %v", err)
+	}
+	if err := tmdb.GetDailyExports(t.Context()); err != nil {
+		t.Fatalf("GetDailyExports() error = %v", err)
+	}
+
+	return tmdb
+}
+
+// Read the JSONL data file and return the lines
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	rf, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer func() { _ = rf.Close() }()
+
+	var lines []string
+	r := bufio.NewScanner(rf)
+	for r.Scan() {
+		lines = append(lines, r.Text())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+
+	return lines
+}
+
+// Return the sorted IDs found in the JSONL data file
+func readIDs(t *testing.T, path string) []int64 {
+	t.Helper()
+
+	var ids []int64
+	for _, line := range readLines(t, path) {
+		var record struct {
+			Id int64 `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		ids = append(ids, record.Id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestNewMovieDB(t *testing.T) {
+	tmdb := testMovieDB(t)
+
+	if got := tmdb.ExportDate.Format("2006-01-02"); got != testExportDate {
+		t.Errorf("ExportDate = %s, want %s", got, testExportDate)
+	}
+	if tmdb.APIKey != "test-key" {
+		t.Errorf("APIKey = %q, want %q", tmdb.APIKey, "test-key")
+	}
+	if len(tmdb.DailyExports) != 7 {
+		t.Errorf("len(DailyExports) = %d, want 7", len(tmdb.DailyExports))
+	}
+}
+
+func TestNewMovieDBDefaultExportDate(t *testing.T) {
+	tmdb, err := NewMovieDB("test-key", "")
+	if err != nil {
+		t.Fatalf("NewMovieDB() error = %v", err)
+	}
+
+	// Exports are available by 8:00 AM UTC, before then we expect yesterday
+	want := time.Now().UTC()
+	if want.Hour() < 8 {
+		want = want.Add(-24 * time.Hour)
+	}
+	if got := tmdb.ExportDate.Format("2006-01-02"); got != want.Format("2006-01-02") {
+		t.Errorf("ExportDate = %s, want %s", got, want.Format("2006-01-02"))
+	}
+}
+
+func TestParseExportDate(t *testing.T) {
+	now := time.Date(2024, 5, 2, 7, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		exportDate string
+		want       string
+		wantErr    bool
+	}{
+		{"", "2024-05-01", false},
+		{"2024-05-02", "2024-05-02", false},
+		{"2024-02-29", "2024-02-29", false},
+		{"2024-05-03", "", true},
+		{"2023-02-29", "", true},
+		{"2024-5-1", "", true},
+		{"01-05-2024", "", true},
+		{"yesterday", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseExportDate(tt.exportDate, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseExportDate(%q) error = %v, wantErr %v", tt.exportDate, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got.Format("2006-01-02") != tt.want {
+			t.Errorf("ParseExportDate(%q) = %s, want %s", tt.exportDate, got.Format("2006-01-02"), tt.want)
+		}
+	}
+
+	// After 8:00 AM UTC the latest export is today's
+	if got, _ := ParseExportDate("", now.Add(time.Hour)); got.Format("2006-01-02") != "2024-05-02" {
+		t.Errorf("ParseExportDate() after 8:00 = %s, want 2024-05-02", got.Format("2006-01-02"))
+	}
+}
+
+func TestCheckDailyExports(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+	if err := tmdb.CheckDailyExports(t.Context(), false); err != nil {
+		t.Errorf("CheckDailyExports() error = %v", err)
+	}
+
+	delete(f.exports, "tv_network_ids")
+	err := tmdb.CheckDailyExports(t.Context(), false)
+	if err == nil || !strings.Contains(err.Error(), "tv_network_ids.json") {
+		t.Errorf("CheckDailyExports() error = %v, want the missing TV network export", err)
+	}
+}
+
+func TestCheckDailyExportsFallback(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+
+	// The export for the 2nd is late, only the 1st has been published
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+	tmdb.ExportDate = tmdb.ExportDate.AddDate(0, 0, 1)
+
+	if err := tmdb.CheckDailyExports(t.Context(), false); err == nil {
+		t.Fatal("CheckDailyExports() expected an error without fallback")
+	}
+	if err := tmdb.CheckDailyExports(t.Context(), true); err != nil {
+		t.Fatalf("CheckDailyExports() error = %v", err)
+	}
+	if got := tmdb.ExportDate.Format("2006-01-02"); got != testExportDate {
+		t.Errorf("ExportDate = %s, want %s", got, testExportDate)
+	}
+}
+
+func TestValidateOutputPath(t *testing.T) {
+	tmdb := testMovieDB(t)
+	dir := t.TempDir()
+
+	// Run twice to make sure an existing directory is accepted
+	for range 2 {
+		if err := tmdb.ValidateOutputPath(dir); err != nil {
+			t.Fatalf("ValidateOutputPath() error = %v", err)
+		}
+	}
+
+	want := filepath.Join(dir, "export_date="+testExportDate)
+	if tmdb.OutputPath != want {
+		t.Errorf("OutputPath = %s, want %s", tmdb.OutputPath, want)
+	}
+	if info, err := os.Stat(want); err != nil || !info.IsDir() {
+		t.Errorf("output path %s was not created: %v", want, err)
+	}
+}
+
+func TestGetDailyExports(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(3)
+
+	tmdb := newTestMovieDB(t, f)
+
+	for key, dailyExport := range tmdb.DailyExports {
+		if got, want := dailyExport.ExportFile, filepath.Join(tmdb.OutputPath, dailyExport.Name); got != want {
+			t.Errorf("%s ExportFile = %s, want %s", key, got, want)
+		}
+		if len(readLines(t, dailyExport.ExportFile)) != 3 {
+			t.Errorf("%s ExportFile does not contain 3 lines", key)
+		}
+	}
+
+	if got, want := tmdb.DailyExports["TV Series"].DataFile, filepath.Join(tmdb.OutputPath, "tv_series.json"); got != want {
+		t.Errorf("TV Series DataFile = %s, want %s", got, want)
+	}
+}
+
+func TestGetDailyExportsMissingFile(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(3)
+	delete(f.exports, "keyword_ids")
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+	if err := tmdb.ValidateOutputPath(t.TempDir()); err != nil {
+		t.Fatalf("ValidateOutputPath() error = %v", err)
+	}
+
+	if err := tmdb.GetDailyExports(t.Context()); err == nil {
+		t.Fatal("GetDailyExports() expected an error for a missing export file")
+	}
+}
+
+func TestGetDailyExportsGzipError(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(3)
+	f.raw["person_ids"] = []byte("this is not gzip data")
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+	if err := tmdb.ValidateOutputPath(t.TempDir()); err != nil {
+		t.Fatalf("ValidateOutputPath() error = %v", err)
+	}
+
+	err := tmdb.GetDailyExports(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "gzip decompress failed") {
+		t.Fatalf("GetDailyExports() error = %v, want gzip decompress failure", err)
+	}
+}
+
+func TestGetDailyExportsTruncatedGzip(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(3)
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, _ = gz.Write(bytes.Repeat([]byte(`{"id":1}`+"\n"), 1000))
+	_ = gz.Close()
+	f.raw["movie_ids"] = b.Bytes()[:b.Len()/2]
+
+	tmdb := testMovieDB(t)
+	tmdb.ExportsURL = f.URL
+	if err := tmdb.ValidateOutputPath(t.TempDir()); err != nil {
+		t.Fatalf("ValidateOutputPath() error = %v", err)
+	}
+
+	err := tmdb.GetDailyExports(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "reading response body failed") {
+		t.Fatalf("GetDailyExports() error = %v, want read failure", err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+// Every entity export, with its API path, exercised around the chunk boundaries
+func TestExportData(t *testing.T) {
+	exports := []struct {
+		key    string
+		kind   string
+		export func(*TheMovieDB, context.Context) error
+	}{
+		{"Movie", "movie", (*TheMovieDB).ExportMovieData},
+		{"TV Series", "tv", (*TheMovieDB).ExportTVSeriesData},
+		{"Person", "person", (*TheMovieDB).ExportPersonData},
+		{"Collection", "collection", (*TheMovieDB).ExportCollectionData},
+		{"TV Network", "network", (*TheMovieDB).ExportTVNetworkData},
+		{"Keyword", "keyword", (*TheMovieDB).ExportKeywordData},
+		{"Company", "company", (*TheMovieDB).ExportCompanyData},
+	}
+
+	f := newFakeTMDB(t)
+	f.setAllIDs(5)
+	tmdb := newTestMovieDB(t, f)
+
+	for _, tt := range exports {
+		t.Run(tt.key, func(t *testing.T) {
+			if err := tt.export(tmdb, t.Context()); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+
+			lines := readLines(t, tmdb.DailyExports[tt.key].DataFile)
+			if len(lines) != 5 {
+				t.Fatalf("exported %d lines, want 5", len(lines))
+			}
+			for _, line := range lines {
+				if !strings.Contains(line, fmt.Sprintf(`"kind":%q`, tt.kind)) {
+					t.Errorf("line %s was not requested from the %s API", line, tt.kind)
+				}
+			}
+		})
+	}
+}
+
+func TestExportDataChunkBoundaries(t *testing.T) {
+	for _, n := range []int{0, 1, int(chunkSize) - 1, int(chunkSize), int(chunkSize) + 1, 2 * int(chunkSize)} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			f := newFakeTMDB(t)
+			f.setAllIDs(1)
+			f.setIDs("movie_ids", n)
+			tmdb := newTestMovieDB(t, f)
+
+			if err := tmdb.ExportMovieData(t.Context()); err != nil {
+				t.Fatalf("ExportMovieData() error = %v", err)
+			}
+
+			ids := readIDs(t, tmdb.DailyExports["Movie"].DataFile)
+			if len(ids) != n {
+				t.Fatalf("exported %d records, want %d", len(ids), n)
+			}
+			for i, id := range ids {
+				if id != int64(i+1) {
+					t.Fatalf("record %d has id %d, want %d", i, id, i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestExportDataEmptyIDFile(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setExport("keyword_ids", nil)
+	tmdb := newTestMovieDB(t, f)
+
+	if err := tmdb.ExportKeywordData(t.Context()); err != nil {
+		t.Fatalf("ExportKeywordData() error = %v", err)
+	}
+
+	info, err := os.Stat(tmdb.DailyExports["Keyword"].DataFile)
+	if err != nil {
+		t.Fatalf("data file was not created: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("data file size = %d, want 0", info.Size())
+	}
+}
+
+func TestExportDataMalformedIDLine(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setExport("production_company_ids", []byte("{\"id\":1,\"name\":\"A\"}\n{\"id\":2,\"name\":\n{\"id\":3,\"name\":\"C\"}\n"))
+	tmdb := newTestMovieDB(t, f)
+
+	err := tmdb.ExportCompanyData(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "failed to unmarshal the company export JSON data") {
+		t.Fatalf("ExportCompanyData() error = %v, want unmarshal failure", err)
+	}
+}
+
+func TestRequestWorkerRetries(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 10)
+	f.status = func(path string, attempt int) int {
+		switch {
+		case path == "/3/movie/3" && attempt <= 2:
+			return http.StatusTooManyRequests
+		case path == "/3/movie/7" && attempt <= 3:
+			return http.StatusBadGateway
+		}
+		return http.StatusOK
+	}
+	tmdb := newTestMovieDB(t, f)
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	if got := f.attemptsFor("/3/movie/3"); got != 3 {
+		t.Errorf("movie 3 attempts = %d, want 3", got)
+	}
+	if got := f.attemptsFor("/3/movie/7"); got != 4 {
+		t.Errorf("movie 7 attempts = %d, want 4", got)
+	}
+	if ids := readIDs(t, tmdb.DailyExports["Movie"].DataFile); len(ids) != 10 {
+		t.Errorf("exported %d records, want 10", len(ids))
+	}
+}
+
+func TestRequestWorkerNoRetryOnNotFound(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 3)
+	f.status = func(path string, attempt int) int {
+		if path == "/3/movie/2" {
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	}
+	tmdb := newTestMovieDB(t, f)
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	if got := f.attemptsFor("/3/movie/2"); got != 1 {
+		t.Errorf("movie 2 attempts = %d, want 1", got)
+	}
+
+	// A failed request is counted rather than written to the output
+	ids := readIDs(t, tmdb.DailyExports["Movie"].DataFile)
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Errorf("exported ids = %v, want [1 3]", ids)
+	}
+	if got := tmdb.DailyExports["Movie"].Progress.Failed; got != 1 {
+		t.Errorf("Failed = %d, want 1", got)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 5)
+	f.delay = func(path string) time.Duration {
+		if path == "/3/movie/4" {
+			return time.Minute
+		}
+		return 0
+	}
+	tmdb := newTestMovieDB(t, f)
+	tmdb.RequestTimeout = 200 * time.Millisecond
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	progress := tmdb.DailyExports["Movie"].Progress
+	if progress.RecordsExported != 4 || progress.Failed != 1 {
+		t.Errorf("exported %d, failed %d, want 4 and 1", progress.RecordsExported, progress.Failed)
+	}
+}
+
+func TestEntityTimeout(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 2*int(chunkSize))
+	f.delay = func(path string) time.Duration {
+		return 20 * time.Millisecond
+	}
+	tmdb := newTestMovieDB(t, f)
+	tmdb.EntityTimeout = 200 * time.Millisecond
+
+	err := tmdb.ExportMovieData(t.Context())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ExportMovieData() error = %v, want context.DeadlineExceeded", err)
+	}
+
+	progress := tmdb.DailyExports["Movie"].Progress
+	if !progress.TimedOut || progress.Interrupted {
+		t.Errorf("progress = %+v, want timed out only", *progress)
+	}
+	if progress.IDsRead >= 2*chunkSize {
+		t.Errorf("IDsRead = %d, expected dispatching to stop early", progress.IDsRead)
+	}
+	if ids := readIDs(t, tmdb.DailyExports["Movie"].DataFile); int64(len(ids)) != progress.RecordsExported {
+		t.Errorf("data file has %d records, progress has %d", len(ids), progress.RecordsExported)
+	}
+}
+
+func TestEntityTimeoutStalledRequest(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.delay = func(path string) time.Duration {
+		return 5 * time.Second
+	}
+	tmdb := newTestMovieDB(t, f)
+	tmdb.RequestTimeout = time.Hour
+	tmdb.EntityTimeout = 100 * time.Millisecond
+
+	// A stalled request is abandoned at the entity deadline, not the request
+	// timeout
+	start := time.Now()
+	err := tmdb.ExportMovieData(t.Context())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ExportMovieData() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("ExportMovieData() took %s, want it to stop at the entity timeout", elapsed)
+	}
+}
+
+func TestExportDataInterrupted(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 2*int(chunkSize))
+	tmdb := newTestMovieDB(t, f)
+
+	// Request a shutdown part way through the first chunk
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	f.status = func(path string, attempt int) int {
+		if path == "/3/movie/100" {
+			cancel()
+		}
+		return http.StatusOK
+	}
+
+	err := tmdb.ExportMovieData(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ExportMovieData() error = %v, want context.Canceled", err)
+	}
+
+	progress := tmdb.DailyExports["Movie"].Progress
+	if !progress.Interrupted {
+		t.Error("progress was not marked as interrupted")
+	}
+	// Only the requests in-flight at the time of the shutdown should complete
+	if progress.IDsRead >= chunkSize {
+		t.Errorf("IDsRead = %d, expected dispatching to stop promptly", progress.IDsRead)
+	}
+
+	// Every line written must be a complete record
+	ids := readIDs(t, tmdb.DailyExports["Movie"].DataFile)
+	if int64(len(ids)) != progress.RecordsExported {
+		t.Errorf("data file has %d records, progress has %d", len(ids), progress.RecordsExported)
+	}
+	if progress.RecordsExported+progress.Failed+progress.Skipped != progress.IDsRead {
+		t.Errorf("exported %d + failed %d + skipped %d != read %d", progress.RecordsExported, progress.Failed, progress.Skipped, progress.IDsRead)
+	}
+
+	if err := tmdb.WriteProgress(); err != nil {
+		t.Fatalf("WriteProgress() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmdb.OutputPath, "progress.json"))
+	if err != nil {
+		t.Fatalf("progress file was not written: %v", err)
+	}
+	var written map[string]ExportProgress
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("invalid progress file: %v", err)
+	}
+	if written["Movie"] != *progress {
+		t.Errorf("progress file = %+v, want %+v", written["Movie"], *progress)
+	}
+}
+
+func TestExportDataPopularityOrder(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(10)
+
+	tmdb := newTestMovieDB(t, f)
+	tmdb.Workers = 1
+	tmdb.PopularityOrder = true
+	filter, err := ParseFilter("popularity>=3")
+	if err != nil {
+		t.Fatalf("ParseFilter() error = %v", err)
+	}
+	tmdb.Filter = filter
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	// With a single worker the records are written in dispatch order
+	var got []string
+	for _, line := range readLines(t, tmdb.DailyExports["Movie"].DataFile) {
+		var record struct {
+			Id int64 `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		got = append(got, strconv.FormatInt(record.Id, 10))
+	}
+	if want := "10,9,8,7,6,5,4,3"; strings.Join(got, ",") != want {
+		t.Errorf("export order = %s, want %s", strings.Join(got, ","), want)
+	}
+	if progress := tmdb.DailyExports["Movie"].Progress; progress.IDsRead != 10 || progress.Filtered != 2 {
+		t.Errorf("progress = %+v", *progress)
+	}
+}
+
+func TestExportDataRequestBudget(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(20)
+
+	tmdb := newTestMovieDB(t, f)
+	tmdb.EntityBudget = 12
+	tmdb.RunBudget = 18
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+	if progress := tmdb.DailyExports["Movie"].Progress; progress.RecordsExported != 12 || progress.BudgetExhausted != "entity requests" {
+		t.Errorf("Movie progress = %+v", *progress)
+	}
+
+	// The run budget is shared, leaving six requests for the next entity
+	if err := tmdb.ExportTVSeriesData(t.Context()); err != nil {
+		t.Fatalf("ExportTVSeriesData() error = %v", err)
+	}
+	if progress := tmdb.DailyExports["TV Series"].Progress; progress.RecordsExported != 6 || progress.BudgetExhausted != "run requests" {
+		t.Errorf("TV Series progress = %+v", *progress)
+	}
+	if attempts := f.attemptsFor("/3/tv/7"); attempts != 0 {
+		t.Errorf("request beyond the budget was made %d times", attempts)
+	}
+}
+
+func TestExportDataRequestBudgetRetries(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(10)
+	f.status = func(path string, attempt int) int {
+		if path == "/3/movie/1" {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	}
+
+	tmdb := newTestMovieDB(t, f)
+	tmdb.Workers = 1
+	tmdb.RunBudget = 6
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	// Every retry is taken from the budget, so no more than six requests are made
+	var attempts int
+	for id := 1; id <= 10; id++ {
+		attempts += f.attemptsFor(fmt.Sprintf("/3/movie/%d", id))
+	}
+	if attempts > 6 {
+		t.Errorf("requests made = %d, want at most 6", attempts)
+	}
+	progress := tmdb.DailyExports["Movie"].Progress
+	if progress.BudgetExhausted != "run requests" || progress.Failed != 0 || progress.Skipped != 1 {
+		t.Errorf("Movie progress = %+v", *progress)
+	}
+
+	// The later entity is not started, leaving its data file untouched
+	if err := os.WriteFile(tmdb.DailyExports["Keyword"].DataFile, []byte(`{"id":1}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmdb.ExportKeywordData(t.Context()); err != nil {
+		t.Fatalf("ExportKeywordData() error = %v", err)
+	}
+	if progress := tmdb.DailyExports["Keyword"].Progress; progress.BudgetExhausted != "run requests" {
+		t.Errorf("Keyword progress = %+v", *progress)
+	}
+	if lines := readLines(t, tmdb.DailyExports["Keyword"].DataFile); len(lines) != 1 {
+		t.Errorf("Keyword data file = %v, want the earlier record kept", lines)
+	}
+}
+
+func TestExportDataTimeBox(t *testing.T) {
+	f := newFakeTMDB(t)
+	f.setAllIDs(50)
+	f.delay = func(string) time.Duration { return 20 * time.Millisecond }
+
+	tmdb := newTestMovieDB(t, f)
+	tmdb.Workers = 1
+	tmdb.EntityTimeBox = 100 * time.Millisecond
+
+	if err := tmdb.ExportMovieData(t.Context()); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+
+	// Dispatch stops at the time box, the in-flight request is still written
+	progress := tmdb.DailyExports["Movie"].Progress
+	if progress.BudgetExhausted != "time box" || progress.Interrupted || progress.TimedOut {
+		t.Errorf("progress = %+v", *progress)
+	}
+	if progress.RecordsExported == 0 || progress.RecordsExported >= 50 || progress.Failed != 0 || progress.Skipped != 0 {
+		t.Errorf("progress = %+v", *progress)
+	}
+}
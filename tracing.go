@@ -0,0 +1,185 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer for the crawl, the spans go nowhere until tracing has been setup.
+// A run is traced as run → entity export → chunk → API request, with the
+// retries of a request recorded as events on its span.
+var tracer = otel.Tracer("github.com/wintermi/get-tmdb")
+
+// Flush and Stop the tracer provider, replaced once tracing has been setup
+var shutdownTracing = func(ctx context.Context) error { return nil }
+
+//---------------------------------------------------------------------------------------
+
+// Setup Tracing, exporting the spans over OTLP/HTTP to the endpoint, e.g.
+// http://localhost:4318, sending to /v1/traces unless another path is given.
+// The standard OTEL_EXPORTER_OTLP_* environment variables, such as for
+// headers, are also honoured.
+func SetupTracing(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid trace endpoint %q, expected a URL such as http://localhost:4318", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return fmt.Errorf("failed to create the trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "get-tmdb"),
+			attribute.String("service.version", "0.1.0"),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	shutdownTracing = provider.Shutdown
+
+	return nil
+}
+
+// End the span of the context, recording the error if there is one, then
+// flush every span so none are lost when the process exits
+func endTracing(ctx context.Context, err error) {
+	endSpan(trace.SpanFromContext(ctx), err)
+
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Error().Err(err).Msg("Flush Traces Failed")
+	}
+}
+
+// End the span, recording the error if there is one
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//---------------------------------------------------------------------------------------
+
+// Span covering a chunk of IDs, in the order they are dispatched, from the
+// first being dispatched until the last has been written.  The time spent
+// writing the records is recorded so it can be compared with the API latency.
+type traceChunk struct {
+	ctx  context.Context
+	span trace.Span
+
+	mu      sync.Mutex
+	ids     int64
+	pending int64
+	sealed  bool
+	write   time.Duration
+}
+
+type traceChunkKey struct{}
+
+func startTraceChunk(ctx context.Context, entity string, index int64) *traceChunk {
+	c := new(traceChunk)
+	ctx, c.span = tracer.Start(ctx, "chunk", trace.WithAttributes(
+		attribute.String("entity", entity),
+		attribute.Int64("chunk", index),
+	))
+	c.ctx = context.WithValue(ctx, traceChunkKey{}, c)
+
+	return c
+}
+
+// Return the chunk of the request context, or nil if it is not in one
+func traceChunkFrom(ctx context.Context) *traceChunk {
+	c, _ := ctx.Value(traceChunkKey{}).(*traceChunk)
+	return c
+}
+
+// Add an ID about to be dispatched to the chunk
+func (c *traceChunk) add() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids++
+	c.pending++
+}
+
+// Remove an ID which failed to be dispatched from the chunk
+func (c *traceChunk) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids--
+	c.pending--
+	c.endIfDone()
+}
+
+// Seal the chunk once no more IDs will be added, ending it once every ID
+// has been written
+func (c *traceChunk) seal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sealed = true
+	c.endIfDone()
+}
+
+// Record an ID of the chunk as written, or skipped, and the time taken
+func (c *traceChunk) done(write time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending--
+	c.write += write
+	c.endIfDone()
+}
+
+func (c *traceChunk) endIfDone() {
+	if !c.sealed || c.pending > 0 {
+		return
+	}
+	c.span.SetAttributes(
+		attribute.Int64("ids", c.ids),
+		attribute.Int64("write_ms", c.write.Milliseconds()),
+	)
+	c.span.End()
+}
+
+// Record the Result as written to its chunk, if it has one
+func (result *RequestResult) finishChunk(write time.Duration) {
+	if result != nil {
+		result.chunk.done(write)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2024, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Record the spans of the test in memory
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() { tracer = previous })
+
+	return recorder
+}
+
+func TestExportDataTracing(t *testing.T) {
+	recorder := recordSpans(t)
+
+	f := newFakeTMDB(t)
+	f.setAllIDs(1)
+	f.setIDs("movie_ids", 10)
+	f.status = func(path string, attempt int) int {
+		if path == "/3/movie/3" && attempt == 1 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	}
+	tmdb := newTestMovieDB(t, f)
+
+	ctx, run := tracer.Start(t.Context(), "run")
+	if err := tmdb.ExportMovieData(ctx); err != nil {
+		t.Fatalf("ExportMovieData() error = %v", err)
+	}
+	run.End()
+
+	// Every span has ended, each the child of the one above it
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	if len(spans["run"]) != 1 || len(spans["export"]) != 1 || len(spans["chunk"]) != 1 || len(spans["GET"]) != 10 {
+		t.Fatalf("ended spans = %v", spans)
+	}
+	parents := map[string]string{"export": "run", "chunk": "export", "GET": "chunk"}
+	for child, parent := range parents {
+		for _, span := range spans[child] {
+			if span.Parent().SpanID() != spans[parent][0].SpanContext().SpanID() {
+				t.Errorf("%s span is not a child of the %s span", child, parent)
+			}
+		}
+	}
+
+	var retries int
+	for _, span := range spans["GET"] {
+		for _, event := range span.Events() {
+			if event.Name == "retry" {
+				retries++
+			}
+		}
+	}
+	if retries != 1 {
+		t.Errorf("retry events = %d, want 1", retries)
+	}
+
+	for _, attr := range spans["chunk"][0].Attributes() {
+		if attr.Key == "ids" && attr.Value.AsInt64() != 10 {
+			t.Errorf("chunk ids = %d, want 10", attr.Value.AsInt64())
+		}
+	}
+}
+
+func TestSetupTracingCollector(t *testing.T) {
+	var received atomic.Int64
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/traces" {
+			received.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	// The provider is shut down by endTracing, so later spans are dropped
+	t.Cleanup(func() { shutdownTracing = func(ctx context.Context) error { return nil } })
+
+	if err := SetupTracing("localhost"); err == nil {
+		t.Error("expected an error for an endpoint without a scheme")
+	}
+	if err := SetupTracing(collector.URL); err != nil {
+		t.Fatalf("SetupTracing() error = %v", err)
+	}
+
+	ctx, _ := otel.Tracer("test").Start(t.Context(), "run")
+	endTracing(ctx, nil)
+
+	if received.Load() == 0 {
+		t.Error("the collector received no spans")
+	}
+}